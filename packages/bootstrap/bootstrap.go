@@ -19,12 +19,25 @@ func BootstrapIterator(initConfig *config.InitConfig) error {
   log.Info("Log level is: %s", initConfig.Server.LogLevel)
 
   storage.InitStorage(initConfig)
-  terraform.InitTerraform(initConfig)
+  err := terraform.ResolveSources(initConfig)
+  if err != nil {
+    return fmt.Errorf("Could not resolve task sources: %v", err)
+  }
+
+  err = terraform.ValidateVariables(initConfig)
+  if err != nil {
+    return fmt.Errorf("Could not validate task variables: %v", err)
+  }
+
+  err = terraform.InitTerraform(initConfig)
+  if err != nil {
+    log.Error("Terraform initialization incomplete, tasks will not accept alerts until their module initializes: %v", err)
+  }
 
   ymlConfigPath := fmt.Sprintf("%s/config.yml", initConfig.Server.DataDir)
 
   // Render YAML configuration based on the loaded HCL config
-  err := config.RenderConfig(initConfig, ymlConfigPath)
+  err = config.RenderConfig(initConfig, ymlConfigPath)
   if err != nil {
     log.Fatal("Error rendering YAML config: %w", err)
   }
@@ -0,0 +1,44 @@
+package cli
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "net/http"
+)
+
+// handleAck asks the server to resume the runs of a flapping alert, identified by the key listed by the status command.
+func (app *App) handleAck(key string) error {
+  jsonData, err := json.Marshal(map[string]string{"key": key})
+  if err != nil {
+    return fmt.Errorf("error marshaling ack data: %v", err)
+  }
+
+  address := fmt.Sprintf("http://%s", app.Config.Server.Address)
+  endpoint := "/api/v1/flaps/ack"
+
+  resp, err := http.Post(address+endpoint, "application/json", bytes.NewBuffer(jsonData))
+  if err != nil {
+    return fmt.Errorf("error sending ack request: %v", err)
+  }
+  defer func() {
+    if err := resp.Body.Close(); err != nil {
+      log.Printf("Error closing response body: %v", err)
+    }
+  }()
+
+  body, err := ioutil.ReadAll(resp.Body)
+  if err != nil {
+    return fmt.Errorf("error reading response body: %v", err)
+  }
+
+  if resp.StatusCode != http.StatusOK {
+    return fmt.Errorf("server response: %s", string(body))
+  }
+
+  log.Printf("Flapping of alert %s acknowledged", key)
+
+  return nil
+}
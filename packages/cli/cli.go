@@ -8,6 +8,7 @@ import (
   "github.com/cloudputation/iterator/packages/bootstrap"
   "github.com/cloudputation/iterator/packages/config"
   log "github.com/cloudputation/iterator/packages/logger"
+  "github.com/cloudputation/iterator/packages/terraform"
 )
 
 type App struct {
@@ -60,7 +61,7 @@ func NewApp() *App {
 func (app *App) setupCommands() {
   var releaseCmd = &cobra.Command{
     Use:   "release [alert name]",
-    Short: "Release Terraform resources for the specified alert",
+    Short: "Release Terraform resources for the specified alert, destroying sawtooth resources and restoring inverse ones",
     Args:  cobra.ExactArgs(1),
     Run: func(cmd *cobra.Command, args []string) {
       alertName := args[0]
@@ -70,5 +71,44 @@ func (app *App) setupCommands() {
     },
   }
 
+  var checksumCmd = &cobra.Command{
+    Use:   "checksum [module directory]",
+    Short: "Print the checksum of a Terraform module, to be used as a task source_checksum",
+    Args:  cobra.ExactArgs(1),
+    Run: func(cmd *cobra.Command, args []string) {
+      checksum, err := terraform.ModuleChecksum(args[0])
+      if err != nil {
+        fmt.Printf("Failed to compute module checksum: %v\n", err)
+        return
+      }
+      fmt.Println(checksum)
+    },
+  }
+
+  var statusCmd = &cobra.Command{
+    Use:   "status",
+    Short: "List the sawtooth deployments pending release, with the time left before they're released, and the flapping alerts",
+    Args:  cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+      if err := app.handleStatus(); err != nil {
+        fmt.Printf("Failed to get status: %v\n", err)
+      }
+    },
+  }
+
+  var ackCmd = &cobra.Command{
+    Use:   "ack [flap key]",
+    Short: "Acknowledge a flapping alert, resuming the runs suspended for it",
+    Args:  cobra.ExactArgs(1),
+    Run: func(cmd *cobra.Command, args []string) {
+      if err := app.handleAck(args[0]); err != nil {
+        fmt.Printf("Failed to acknowledge flapping alert: %v\n", err)
+      }
+    },
+  }
+
   app.RootCmd.AddCommand(releaseCmd)
+  app.RootCmd.AddCommand(statusCmd)
+  app.RootCmd.AddCommand(ackCmd)
+  app.RootCmd.AddCommand(checksumCmd)
 }
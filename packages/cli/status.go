@@ -0,0 +1,107 @@
+package cli
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "os"
+  "text/tabwriter"
+  "time"
+)
+
+// pendingRelease is a sawtooth deployment waiting for its time-to-live to expire, as listed by the server
+type pendingRelease struct {
+  Key         string    `json:"key"`
+  AlertName   string    `json:"alert_name"`
+  Fingerprint string    `json:"fingerprint"`
+  Task        string    `json:"task"`
+  Module      string    `json:"module"`
+  ReleaseAt   time.Time `json:"release_at"`
+}
+
+// flappingAlert is an alert whose runs are suspended because it flaps, as listed by the server
+type flappingAlert struct {
+  Key         string    `json:"key"`
+  AlertName   string    `json:"alert_name"`
+  Fingerprint string    `json:"fingerprint"`
+  Task        string    `json:"task"`
+  Transitions int       `json:"transitions"`
+  SuspendedAt time.Time `json:"suspended_at"`
+}
+
+// handleStatus lists the pending releases of the server, with the time left before each of them,
+// and the alerts whose runs are suspended because they flap.
+func (app *App) handleStatus() error {
+  var releases []pendingRelease
+  if err := app.getStatus("/api/v1/releases", &releases); err != nil {
+    return err
+  }
+
+  var flapping []flappingAlert
+  if err := app.getStatus("/api/v1/flaps", &flapping); err != nil {
+    return err
+  }
+
+  if len(releases) == 0 {
+    fmt.Println("No pending releases")
+  } else {
+    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "ALERT\tKEY\tTASK\tRELEASE AT\tRELEASE IN")
+    for _, release := range releases {
+      countdown := "due"
+      if remaining := time.Until(release.ReleaseAt); remaining > 0 {
+        countdown = remaining.Round(time.Second).String()
+      }
+      fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", release.AlertName, release.Key, release.Task, release.ReleaseAt.Local().Format(time.RFC3339), countdown)
+    }
+    if err := w.Flush(); err != nil {
+      return err
+    }
+  }
+
+  if len(flapping) == 0 {
+    fmt.Println("No flapping alerts")
+    return nil
+  }
+
+  fmt.Println()
+  w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+  fmt.Fprintln(w, "FLAPPING ALERT\tKEY\tTASK\tTRANSITIONS\tSUSPENDED AT")
+  for _, flap := range flapping {
+    fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", flap.AlertName, flap.Key, flap.Task, flap.Transitions, flap.SuspendedAt.Local().Format(time.RFC3339))
+  }
+
+  return w.Flush()
+}
+
+// getStatus decodes the JSON response of a status endpoint of the server into v.
+func (app *App) getStatus(endpoint string, v interface{}) error {
+  address := fmt.Sprintf("http://%s", app.Config.Server.Address)
+
+  resp, err := http.Get(address + endpoint)
+  if err != nil {
+    return fmt.Errorf("error sending status request: %v", err)
+  }
+  defer func() {
+    if err := resp.Body.Close(); err != nil {
+      log.Printf("Error closing response body: %v", err)
+    }
+  }()
+
+  body, err := ioutil.ReadAll(resp.Body)
+  if err != nil {
+    return fmt.Errorf("error reading response body: %v", err)
+  }
+
+  if resp.StatusCode != http.StatusOK {
+    return fmt.Errorf("server response: %s", string(body))
+  }
+
+  if err := json.Unmarshal(body, v); err != nil {
+    return fmt.Errorf("error decoding %s: %v", endpoint, err)
+  }
+
+  return nil
+}
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"errors"
 	"fmt"
 	"github.com/prometheus/alertmanager/template"
 	l "log"
@@ -10,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 	"unicode"
 
 	log "github.com/cloudputation/iterator/packages/logger"
@@ -69,6 +71,28 @@ var (
 
 type Result int
 
+// ModeAggregate is the mode of commands applying all their firing instances at once
+const ModeAggregate = "aggregate"
+
+// SchedulingScale is the scheduling mode of commands stepping a counter up on fire and down on resolve
+const SchedulingScale = "scale"
+
+// SchedulingInverse is the scheduling mode of commands destroying their module on fire and re-applying it on resolve
+const SchedulingInverse = "inverse"
+
+// DefaultResolvedSignal is sent to the process group of a command whose alert resolved when no resolved_signal is configured.
+// Terraform stops gracefully on SIGINT, releasing its state lock.
+const DefaultResolvedSignal = syscall.SIGINT
+
+// DefaultResolvedGracePeriod is how long a signalled command has to exit when no grace period is configured
+const DefaultResolvedGracePeriod = 30 * time.Second
+
+// DefaultAggregateWindow is how long changes to the instances of an aggregate command are coalesced when no window is configured
+const DefaultAggregateWindow = 30 * time.Second
+
+// CooldownScopeFingerprint is the cooldown scope of commands only holding back the fingerprint that started a cooldown
+const CooldownScopeFingerprint = "fingerprint"
+
 type CommandResult struct {
 	Kind Result
 	Err  error
@@ -76,8 +100,16 @@ type CommandResult struct {
 
 // Command represents a command that could be run based on what labels match
 type Command struct {
+	// Name of the task the command was rendered from
+	Task string   `yaml:"task,omitempty"`
 	Cmd  string   `yaml:"cmd"`
 	Args []string `yaml:"args"`
+	// Terraform module directory the command runs on
+	Source string `yaml:"source,omitempty"`
+	// HCL expression the module directory is rendered from for each alert, instead of Source.
+	// The rendered directory must match one of the AllowedSources glob patterns.
+	SourceTemplate string   `yaml:"source_template,omitempty"`
+	AllowedSources []string `yaml:"allowed_sources,omitempty"`
 	// Only execute this command when all of the given labels match.
 	// The CommonLabels field of prometheus alert data is used for comparison.
 	MatchLabels map[string]string `yaml:"match_labels"`
@@ -95,12 +127,135 @@ type Command struct {
 	// Defaults to false.
 	IgnoreResolved *bool  `yaml:"ignore_resolved,omitempty"`
 	ResolvedSig    string `yaml:"resolved_signal"`
+	// How long a signalled command has to exit before its process group is killed.
+	// Defaults to DefaultResolvedGracePeriod.
+	ResolvedGracePeriod string `yaml:"resolved_grace_period,omitempty"`
 	// Evaluate if terraform destroy should be run
 	DestroyOnResolved *bool `yaml:"destroy_on_resolved,omitempty"`
 	// Available scheduling modes based on alert status
 	// Regular, firing -> apply, resolved -> destroy
 	// Sawtooth, firing -> apply, resolved -> ignore
 	TerraformScheduling string `yaml:"terraform_scheduling,omitempty"`
+	// Consul KV path the Terraform outputs of each applied alert are published under
+	OutputsPath string `yaml:"outputs_path,omitempty"`
+	// Terraform -target, -replace and -refresh-only options.
+	// These hold HCL expressions evaluated against the triggering alert.
+	Targets     string `yaml:"targets,omitempty"`
+	Replace     string `yaml:"replace,omitempty"`
+	RefreshOnly string `yaml:"refresh_only,omitempty"`
+	// Backend configuration passed to init, as HCL expressions evaluated against the triggering alert
+	BackendConfig map[string]string `yaml:"backend_config,omitempty"`
+	// Module input variables, as HCL expressions evaluated against the triggering alert
+	Variables map[string]string `yaml:"variables,omitempty"`
+	// Workspace the command runs in, either "per_fingerprint" or an HCL expression evaluated against the triggering alert
+	Workspace string `yaml:"workspace,omitempty"`
+	// Run each alert fingerprint in its own working copy of the module
+	WorkingCopy bool `yaml:"working_copy,omitempty"`
+	// Checksum the module must match before it is applied or destroyed
+	SourceChecksum string `yaml:"source_checksum,omitempty"`
+	// HCL expression evaluating to the list of elements the module is applied for, once per element.
+	// Elements are applied in parallel, or one after the other when Rollout is "sequential",
+	// in which case HaltOnFailure stops the rollout at the first failed element.
+	ForEach       string `yaml:"for_each,omitempty"`
+	Rollout       string `yaml:"rollout,omitempty"`
+	HaltOnFailure bool   `yaml:"halt_on_failure,omitempty"`
+	// In "aggregate" mode, the module is applied once for all the firing instances of the command,
+	// passed as a list in the AggregateVariable input. Changes to the set are coalesced within AggregateWindow.
+	Mode              string `yaml:"mode,omitempty"`
+	AggregateWindow   string `yaml:"aggregate_window,omitempty"`
+	AggregateVariable string `yaml:"aggregate_variable,omitempty"`
+	// Bounds of the counter of commands using the scale scheduling mode
+	Scale *Scale `yaml:"scale,omitempty"`
+	// Escalation ladder of the command, from the lowest severity to the highest
+	Escalation *Escalation `yaml:"escalation,omitempty"`
+	// How long a sawtooth deployment lives before it is released
+	ReleaseAfter string `yaml:"release_after,omitempty"`
+	// Lease of the alert records of the command, renewed by every firing notification
+	Lease *Lease `yaml:"lease,omitempty"`
+	// How long the destroy of a resolved alert is held back, cancelled if the alert fires again
+	ResolveDelay string `yaml:"resolve_delay,omitempty"`
+	// How long an alert must keep firing before the command runs for it
+	FireDelay string `yaml:"fire_delay,omitempty"`
+	// Runs are suspended for alerts flapping beyond the threshold of FlapDetection
+	FlapDetection *FlapDetection `yaml:"flap_detection,omitempty"`
+	// Firing alerts are skipped for a while after the command applied or destroyed,
+	// for the whole task, or only for the same fingerprint when CooldownScope is "fingerprint"
+	CooldownAfterApply   string `yaml:"cooldown_after_apply,omitempty"`
+	CooldownAfterDestroy string `yaml:"cooldown_after_destroy,omitempty"`
+	CooldownScope        string `yaml:"cooldown_scope,omitempty"`
+	// Durations of the command, parsed from the settings above by ParseDurations when the configuration is read
+	Durations Durations `yaml:"-"`
+}
+
+// Durations holds the parsed durations of a command. Unset durations are zero,
+// but for the grace period and the aggregate window which hold their defaults.
+type Durations struct {
+	ResolvedGracePeriod  time.Duration
+	ReleaseAfter         time.Duration
+	ResolveDelay         time.Duration
+	FireDelay            time.Duration
+	CooldownAfterApply   time.Duration
+	CooldownAfterDestroy time.Duration
+	AggregateWindow      time.Duration
+	ScaleCooldown        time.Duration
+	FlapWindow           time.Duration
+	Lease                time.Duration
+}
+
+// FlapDetection suspends the runs of an alert once it fired or resolved Threshold times within the sliding Window.
+type FlapDetection struct {
+	Window    string `yaml:"window"`
+	Threshold int    `yaml:"threshold"`
+}
+
+// Lease sets how long an alert record lives without a firing notification renewing it,
+// as a Multiple of the repeat interval of the Alertmanager route sending the alert.
+type Lease struct {
+	RepeatInterval string `yaml:"repeat_interval"`
+	Multiple       int    `yaml:"multiple"`
+}
+
+// Duration returns how long a lease lasts once renewed
+func (l *Lease) Duration() (time.Duration, error) {
+	interval, err := time.ParseDuration(l.RepeatInterval)
+	if err != nil {
+		return 0, err
+	}
+	return interval * time.Duration(l.Multiple), nil
+}
+
+// Scale bounds the counter of a command using the scale scheduling mode.
+// The counter is passed to the module in Variable, and stepped by Step at most once per Cooldown.
+type Scale struct {
+	Variable string `yaml:"variable"`
+	Min      int    `yaml:"min"`
+	Max      int    `yaml:"max"`
+	Step     int    `yaml:"step"`
+	Cooldown string `yaml:"cooldown,omitempty"`
+}
+
+// Escalation re-applies the target of an alert with the inputs of the highest severity firing for it.
+// Alerts sharing the TargetLabels, or all their labels but the SeverityLabel when unset, are the same target.
+type Escalation struct {
+	SeverityLabel string           `yaml:"severity_label"`
+	TargetLabels  []string         `yaml:"target_labels,omitempty"`
+	Steps         []EscalationStep `yaml:"steps"`
+}
+
+// EscalationStep holds the module inputs of a severity, overriding the command variables
+type EscalationStep struct {
+	Severity  string            `yaml:"severity"`
+	Variables map[string]string `yaml:"variables,omitempty"`
+}
+
+// Step returns the index of the step of a severity in the ladder, or -1 if the severity has no step
+func (e *Escalation) Step(severity string) int {
+	for i, step := range e.Steps {
+		if step.Severity == severity {
+			return i
+		}
+	}
+	return -1
 }
 
 // Return a string representing the result state
@@ -208,6 +363,9 @@ func (c Command) Matches(alert *template.Alert) bool {
 // out channel is used to indicate the result of running or killing the program. May indicate errors.
 // quit channel is used to determine if execution should quit early
 // done channel is used to indicate to caller when execution has completed
+//
+// The command runs in its own process group, so that the resolved signal reaches the processes it spawned,
+// like Terraform provider plugins. The group is killed if it is still running once the grace period is over.
 func (c Command) Run(out chan<- CommandResult, quit chan struct{}, done chan struct{}, env ...string) {
     defer close(out)
     defer close(done)
@@ -218,40 +376,172 @@ func (c Command) Run(out chan<- CommandResult, quit chan struct{}, done chan str
 
     // Setting up the command with the environment variables.
     cmd := c.WithEnv(env...)
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-    // Executing the command.
-    err := cmd.Run()
-    if err == nil {
-        out <- CommandResult{Kind: CmdOk, Err: nil}
-    } else {
+    // Starting the command, and waiting for it to exit in the background.
+    err := cmd.Start()
+    if err != nil {
         out <- CommandResult{Kind: CmdFail, Err: err}
+        return
     }
+    exited := make(chan error, 1)
+    go func() {
+        exited <- cmd.Wait()
+    }()
 
-    // Handling the quit signal.
+    // Handling the quit signal while the command runs.
     select {
+    case err := <-exited:
+        out <- exitResult(err)
+        return
     case <-quit:
-        if c.ShouldIgnoreResolved() {
-            out <- CommandResult{Kind: CmdSkipSig, Err: nil}
-        } else {
-            sig, err := c.ParseSignal()
-            if err != nil {
-                errMsg := fmt.Errorf("Can't use signal %s to notify pid %d for command %s: %w", c.ResolvedSig, cmd.Process.Pid, c, err)
-                out <- CommandResult{Kind: CmdSigFail, Err: errMsg}
-            } else {
-                err = cmd.Process.Signal(sig)
-                if err == nil {
-                    out <- CommandResult{Kind: CmdSigOk, Err: nil}
-                } else {
-                    errMsg := fmt.Errorf("Failed sending %s to pid %d for command %s: %w", sig, cmd.Process.Pid, c, err)
-                    out <- CommandResult{Kind: CmdSigFail, Err: errMsg}
-                }
-            }
+    }
+
+    if c.ShouldIgnoreResolved() {
+        out <- CommandResult{Kind: CmdSkipSig, Err: nil}
+        out <- exitResult(<-exited)
+        return
+    }
+
+    pid := cmd.Process.Pid
+    sig, err := c.ParseSignal()
+    if err != nil {
+        errMsg := fmt.Errorf("Can't use signal %s to notify pid %d for command %s: %w", c.ResolvedSig, pid, c, err)
+        out <- CommandResult{Kind: CmdSigFail, Err: errMsg}
+        out <- exitResult(<-exited)
+        return
+    }
+
+    err = signalGroup(pid, sig)
+    if errors.Is(err, syscall.ESRCH) {
+        // The command exited on its own in the meantime
+        out <- exitResult(<-exited)
+        return
+    }
+    if err != nil {
+        errMsg := fmt.Errorf("Failed sending %s to pid %d for command %s: %w", sig, pid, c, err)
+        out <- CommandResult{Kind: CmdSigFail, Err: errMsg}
+        out <- exitResult(<-exited)
+        return
+    }
+    log.Info("Sent %s to process group %d of command %s, its alert resolved", sig, pid, c)
+
+    grace := c.Durations.ResolvedGracePeriod
+    select {
+    case err := <-exited:
+        out <- CommandResult{Kind: CmdSigOk, Err: nil}
+        out <- exitResult(err)
+    case <-time.After(grace):
+        log.Warn("Command %s didn't exit within %s of %s, killing process group %d", c, grace, sig, pid)
+        err = signalGroup(pid, syscall.SIGKILL)
+        if err != nil && !errors.Is(err, syscall.ESRCH) {
+            log.Error("Failed to kill process group %d of command %s: %v", pid, c, err)
         }
-    default:
-    // If no quit signal, just continue.
+        errMsg := fmt.Errorf("Command %s didn't exit within %s of %s and was killed", c, grace, sig)
+        out <- CommandResult{Kind: CmdSigFail, Err: errMsg}
+        out <- exitResult(<-exited)
     }
 }
 
+// exitResult returns the result of a command that exited with the given error
+func exitResult(err error) CommandResult {
+    if err != nil {
+        return CommandResult{Kind: CmdFail, Err: err}
+    }
+    return CommandResult{Kind: CmdOk, Err: nil}
+}
+
+// signalGroup sends a signal to every process of the process group led by pid
+func signalGroup(pid int, sig os.Signal) error {
+    s, ok := sig.(syscall.Signal)
+    if !ok {
+        return fmt.Errorf("Unsupported signal %s", sig)
+    }
+    return syscall.Kill(-pid, s)
+}
+
+// ParseDurations parses the durations configured for the command into its Durations
+func (c *Command) ParseDurations() error {
+	durations := Durations{
+		ResolvedGracePeriod: DefaultResolvedGracePeriod,
+		AggregateWindow:     DefaultAggregateWindow,
+	}
+
+	type setting struct {
+		name     string
+		value    string
+		duration *time.Duration
+	}
+	settings := []setting{
+		{"resolved_grace_period", c.ResolvedGracePeriod, &durations.ResolvedGracePeriod},
+		{"release_after", c.ReleaseAfter, &durations.ReleaseAfter},
+		{"resolve_delay", c.ResolveDelay, &durations.ResolveDelay},
+		{"fire_delay", c.FireDelay, &durations.FireDelay},
+		{"cooldown_after_apply", c.CooldownAfterApply, &durations.CooldownAfterApply},
+		{"cooldown_after_destroy", c.CooldownAfterDestroy, &durations.CooldownAfterDestroy},
+		{"aggregate_window", c.AggregateWindow, &durations.AggregateWindow},
+	}
+	if c.Scale != nil {
+		settings = append(settings, setting{"scale cooldown", c.Scale.Cooldown, &durations.ScaleCooldown})
+	}
+	if c.FlapDetection != nil {
+		settings = append(settings, setting{"flap_detection window", c.FlapDetection.Window, &durations.FlapWindow})
+	}
+
+	for _, s := range settings {
+		if s.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(s.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", s.name, s.value, err)
+		}
+		if duration < 0 {
+			return fmt.Errorf("%s %q can't be negative", s.name, s.value)
+		}
+		*s.duration = duration
+	}
+
+	if c.Lease != nil {
+		lease, err := c.Lease.Duration()
+		if err != nil {
+			return fmt.Errorf("invalid lease repeat_interval %q: %w", c.Lease.RepeatInterval, err)
+		}
+		durations.Lease = lease
+	}
+
+	c.Durations = durations
+	return nil
+}
+
+// IsAggregate returns true if the command runs in aggregate mode
+func (c Command) IsAggregate() bool {
+	return c.Mode == ModeAggregate
+}
+
+// IsScale returns true if the command uses the scale scheduling mode
+func (c Command) IsScale() bool {
+	return c.TerraformScheduling == SchedulingScale
+}
+
+// IsInverse returns true if the command uses the inverse scheduling mode
+func (c Command) IsInverse() bool {
+	return c.TerraformScheduling == SchedulingInverse
+}
+
+// IsEscalation returns true if the command has an escalation ladder
+func (c Command) IsEscalation() bool {
+	return c.Escalation != nil
+}
+
+// FiringCommand returns the Terraform command run when an alert matching the command fires
+func (c Command) FiringCommand() string {
+	if c.IsInverse() {
+		return "destroy"
+	}
+	return "apply"
+}
+
 // ShouldIgnoreResolved returns the interpreted value of c.IgnoreResolved.
 // This method is used to work around ambiguity of unmarshalling yaml boolean values,
 // due to the default value of a bool being false.
@@ -275,10 +565,10 @@ func (c Command) ShouldNotify() bool {
 }
 
 // ParseSignal returns the signal that is meant to be used for notifying the command that its triggering condition has resolved,
-// and any error encountered while parsing.
+// and any error encountered while parsing. Commands without a resolved signal are sent DefaultResolvedSignal.
 func (c Command) ParseSignal() (os.Signal, error) {
 	if len(c.ResolvedSig) == 0 {
-		return os.Kill, nil
+		return DefaultResolvedSignal, nil
 	}
 
 	var notFound = os.Signal(syscall.Signal(-1))
@@ -0,0 +1,91 @@
+package command
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/cloudputation/iterator/packages/logger"
+)
+
+// How long a test waits for a command to be done
+const testTimeout = 5 * time.Second
+
+// runResolved runs the command, resolves its alert once it started, and returns the results it reported
+func runResolved(t *testing.T, c Command) Result {
+	err := log.InitLogger(t.TempDir(), "error")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := make(chan CommandResult)
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go c.Run(out, quit, done)
+
+	// Give the command time to start, and to set up its signal handling
+	time.Sleep(100 * time.Millisecond)
+	close(quit)
+
+	var results Result
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case result, ok := <-out:
+			if !ok {
+				<-done
+				return results
+			}
+			results |= result.Kind
+		case <-timeout:
+			t.Fatalf("command %s wasn't done %s after its alert resolved", c, testTimeout)
+		}
+	}
+}
+
+func TestRunSignalsResolvedCommand(t *testing.T) {
+	// Without a resolved signal, the command is sent DefaultResolvedSignal
+	c := Command{Cmd: "sh", Args: []string{"-c", `trap "exit 0" INT; sleep 5`}}
+	c.Durations.ResolvedGracePeriod = testTimeout
+
+	results := runResolved(t, c)
+	if !results.Has(CmdSigOk) || !results.Has(CmdOk) {
+		t.Fatalf("command exiting on the resolved signal reported %s, want SigOk and Ok", results)
+	}
+}
+
+func TestRunKillsCommandAfterGracePeriod(t *testing.T) {
+	// The command ignores the resolved signal, and only exits once it is killed
+	c := Command{Cmd: "sh", Args: []string{"-c", `trap "" INT; sleep 5`}}
+	c.Durations.ResolvedGracePeriod = 100 * time.Millisecond
+
+	results := runResolved(t, c)
+	if !results.Has(CmdSigFail) || !results.Has(CmdFail) {
+		t.Fatalf("command outliving its grace period reported %s, want SigFail and Fail", results)
+	}
+	if results.Has(CmdSigOk) {
+		t.Fatalf("command outliving its grace period reported %s, it didn't exit on the resolved signal", results)
+	}
+}
+
+func TestRunIgnoresResolvedAlert(t *testing.T) {
+	ignore := true
+	c := Command{Cmd: "sleep", Args: []string{"0.3"}, IgnoreResolved: &ignore}
+
+	results := runResolved(t, c)
+	if !results.Has(CmdSkipSig) || !results.Has(CmdOk) {
+		t.Fatalf("command ignoring resolved alerts reported %s, want SkipSig and Ok", results)
+	}
+	if results.Has(CmdSigOk) || results.Has(CmdSigFail) {
+		t.Fatalf("command ignoring resolved alerts reported %s, it was signalled", results)
+	}
+}
+
+func TestParseSignalDefault(t *testing.T) {
+	sig, err := Command{}.ParseSignal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig != DefaultResolvedSignal {
+		t.Fatalf("command without a resolved signal is sent %s, want %s", sig, DefaultResolvedSignal)
+	}
+}
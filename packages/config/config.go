@@ -92,6 +92,11 @@ func ReadConfig(configFile string) (*Config, error) {
             return nil, fmt.Errorf("invalid resolved_signal specified for command %q at index %d: %w", cmd, i, err)
         }
 
+        err = cmd.ParseDurations()
+        if err != nil {
+            return nil, fmt.Errorf("invalid duration specified for command %q at index %d: %w", cmd, i, err)
+        }
+
         if cmd.IgnoreResolved != nil && *cmd.IgnoreResolved {
             log.Warn("Warning: command %q at index %d specifies a resolved_signal, and also specifies to ignore resolved alert. The signal won't be used.", cmd, i)
         }
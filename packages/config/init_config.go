@@ -2,9 +2,11 @@ package config
 
 import (
     "fmt"
+    "time"
     "github.com/hashicorp/hcl/v2"
     "github.com/hashicorp/hcl/v2/hclparse"
     "github.com/zclconf/go-cty/cty"
+	"github.com/cloudputation/iterator/packages/command"
 	log "github.com/cloudputation/iterator/packages/logger"
 )
 
@@ -20,6 +22,8 @@ type Server struct {
     Listen string
     Address string
     TerraformDriver string
+    // Bearer token required to move git sources to another ref through the API, which is disabled without one
+    SourceUpdateToken string
     Consul          ConsulConfig
 }
 
@@ -31,25 +35,130 @@ type Task struct {
     Name        string
     Description string
     Source      string
+    // Source expression evaluated against each alert, and the directories it may resolve to
+    SourceTemplate string
+    AllowedSources []string
     TerraformDriver string 
+    OutputsPath string
+    // Expression sources evaluated against each alert
+    Targets     string
+    Replace     string
+    RefreshOnly string
+    BackendConfig map[string]string
+    // Module inputs, written to a tfvars file
+    Variables   map[string]string
+    Workspace   string
+    WorkingCopy bool
+    SourceChecksum string
+    // Fan-out over a list of elements, applied in parallel or sequentially
+    ForEach     string
+    Rollout     string
+    HaltOnFailure bool
+    // Aggregate mode applies the set of firing instances at once, coalescing changes within a window
+    Mode        string
+    AggregateWindow string
+    AggregateVariable string
+    Scale       *ScaleConfig
+    // Sawtooth deployments are destroyed once they're older than ReleaseAfter
+    ReleaseAfter string
+    // Alerts that stop being re-sent are resolved once their lease expires
+    Lease       *LeaseConfig
+    // The destroy of a resolved alert is held back for ResolveDelay, and cancelled if the task fires again
+    ResolveDelay string
+    // A firing alert is only applied once it kept firing for FireDelay
+    FireDelay   string
+    // Runs are suspended for alerts flapping beyond the threshold of FlapDetection
+    FlapDetection *FlapDetectionConfig
+    // Firing alerts are skipped for a while after an apply or a destroy, for the whole task or per fingerprint
+    CooldownAfterApply   string
+    CooldownAfterDestroy string
+    CooldownScope        string
+    // Escalation ladder re-applying a target with the inputs of its highest firing severity
+    Escalation  *EscalationConfig
     Condition   Condition
 }
 
+// ScaleConfig bounds the counter of a task using the scale scheduling mode
+type ScaleConfig struct {
+    Variable string `yaml:"variable"`
+    Min      int    `yaml:"min"`
+    Max      int    `yaml:"max"`
+    Step     int    `yaml:"step"`
+    Cooldown string `yaml:"cooldown,omitempty"`
+}
+
+// LeaseConfig sets how long an alert record lives without a firing notification renewing it:
+// Multiple times the repeat interval of the Alertmanager route sending the alert.
+type LeaseConfig struct {
+    RepeatInterval string `yaml:"repeat_interval"`
+    Multiple       int    `yaml:"multiple"`
+}
+
+// FlapDetectionConfig suspends the runs of an alert once it fired or resolved
+// Threshold times within the sliding Window.
+type FlapDetectionConfig struct {
+    Window    string `yaml:"window"`
+    Threshold int    `yaml:"threshold"`
+}
+
+// EscalationConfig is the ladder of severity steps of a task, from the lowest to the highest.
+// Alerts sharing the target labels are the same target, whatever their severity.
+type EscalationConfig struct {
+    SeverityLabel string           `yaml:"severity_label"`
+    TargetLabels  []string         `yaml:"target_labels,omitempty"`
+    Steps         []EscalationStep `yaml:"steps"`
+}
+
+// EscalationStep holds the module inputs of a severity, overriding the task variables
+type EscalationStep struct {
+    Severity  string            `yaml:"severity"`
+    Variables map[string]string `yaml:"variables,omitempty"`
+}
+
 type Condition struct {
     TerraformScheduling string
     NotifyOnFailure bool
     ResolvedSignal  string
     IgnoreResolved  bool
+    // How long a signalled run has to exit before it is killed
+    ResolvedGracePeriod string
+    // Expression sources evaluated against each alert, overriding the task ones
+    Targets         string
+    Replace         string
+    RefreshOnly     string
     Labels          map[string]string
 }
 
 const (
   defaultListenAddr = "9595"
+  // Input variable the instances of an aggregate task are passed in when none is configured
+  DefaultAggregateVariable = "alerts"
+  // Input variable the counter of a scale task is passed in when none is configured
+  DefaultScaleVariable = "scale"
+  // Label holding the severity of alerts escalating a task when none is configured
+  DefaultSeverityLabel = "severity"
+  // Repeat intervals an alert lease outlives when no multiple is configured
+  DefaultLeaseMultiple = 3
+  // Transitions within the window making an alert flap when no threshold is configured
+  DefaultFlapThreshold = 4
 )
 
 var ConsulFactoryDataDir = "iterator::Data"
 var ConsulStorageEnabled bool
 
+// expressionAttributes are task and condition attributes kept as HCL expression source,
+// to be evaluated against the data of each alert.
+var expressionAttributes = map[string]bool{
+  "targets":      true,
+  "replace":      true,
+  "refresh_only": true,
+  "workspace":    true,
+  "for_each":     true,
+}
+
+// configSources holds the content of the parsed configuration files
+var configSources map[string][]byte
+
 func LoadConfig(configPath string) (*InitConfig, error) {
   config := &InitConfig{}
 
@@ -58,6 +167,7 @@ func LoadConfig(configPath string) (*InitConfig, error) {
   if diags.HasErrors() {
       return nil, fmt.Errorf("failed to parse HCL file: %s", diags)
   }
+  configSources = parser.Sources()
 
   content, diags := file.Body.Content(&hcl.BodySchema{
       Blocks: []hcl.BlockHeaderSchema{
@@ -92,6 +202,13 @@ func LoadConfig(configPath string) (*InitConfig, error) {
       }
   }
 
+  for _, task := range config.Tasks {
+      err := validateTask(task)
+      if err != nil {
+          return nil, fmt.Errorf("invalid task %s: %w", task.Name, err)
+      }
+  }
+
   return config, nil
 }
 
@@ -106,6 +223,7 @@ func processServerBlock(serverBlock *hcl.Block) (map[string]interface{}, error)
           {Name: "listen"},
           {Name: "address"},
           {Name: "terraform_driver"},
+          {Name: "source_update_token"},
       },
       Blocks: []hcl.BlockHeaderSchema{
           {Type: "consul"},
@@ -174,6 +292,10 @@ func populateServerStruct(serverMap map[string]interface{}) *Server {
       server.Listen = listen.(string)
   }
 
+  if token, ok := serverMap["source_update_token"]; ok {
+      server.SourceUpdateToken = token.(string)
+  }
+
   if consul, ok := serverMap["consul"].(map[string]interface{}); ok {
       server.Consul = ConsulConfig{
           Address: consul["address"].(string),
@@ -191,10 +313,36 @@ func processTaskBlock(taskBlock *hcl.Block) (map[string]interface{}, error) {
           {Name: "name"},
           {Name: "description"},
           {Name: "source"},
+          {Name: "allowed_sources"},
           {Name: "terraform_driver"},
+          {Name: "outputs_path"},
+          {Name: "targets"},
+          {Name: "replace"},
+          {Name: "refresh_only"},
+          {Name: "workspace"},
+          {Name: "working_copy"},
+          {Name: "source_checksum"},
+          {Name: "for_each"},
+          {Name: "rollout"},
+          {Name: "halt_on_failure"},
+          {Name: "mode"},
+          {Name: "aggregate_window"},
+          {Name: "aggregate_variable"},
+          {Name: "release_after"},
+          {Name: "resolve_delay"},
+          {Name: "fire_delay"},
+          {Name: "cooldown_after_apply"},
+          {Name: "cooldown_after_destroy"},
+          {Name: "cooldown_scope"},
       },
       Blocks: []hcl.BlockHeaderSchema{
           {Type: "condition", LabelNames: []string{"type"}},
+          {Type: "backend_config"},
+          {Type: "variables"},
+          {Type: "scale"},
+          {Type: "escalation"},
+          {Type: "lease"},
+          {Type: "flap_detection"},
       },
   })
   if diags.HasErrors() {
@@ -202,12 +350,33 @@ func processTaskBlock(taskBlock *hcl.Block) (map[string]interface{}, error) {
   }
 
   for k, attr := range content.Attributes {
+      if expressionAttributes[k] {
+          taskData[k] = expressionSource(attr.Expr)
+          continue
+      }
+      if k == "source" && len(attr.Expr.Variables()) > 0 {
+          // The source refers to the alert, it is resolved for each alert
+          taskData["source_template"] = expressionSource(attr.Expr)
+          continue
+      }
       val, diags := attr.Expr.Value(nil)
       if diags.HasErrors() {
           log.Error("Failed to decode attribute value for %s: %s", k, diags)
           continue
       }
-      taskData[k] = val.AsString()
+      switch {
+      case val.Type().Equals(cty.Bool):
+          taskData[k] = val.True()
+      case val.Type().IsTupleType() || val.Type().IsListType():
+          var values []string
+          for it := val.ElementIterator(); it.Next(); {
+              _, v := it.Element()
+              values = append(values, v.AsString())
+          }
+          taskData[k] = values
+      default:
+          taskData[k] = val.AsString()
+      }
   }
 
   for _, block := range content.Blocks {
@@ -220,6 +389,48 @@ func processTaskBlock(taskBlock *hcl.Block) (map[string]interface{}, error) {
               taskData["condition"] = conditionData
           }
       }
+      if block.Type == "backend_config" {
+          backendConfig, err := processExpressionBlock(block)
+          if err != nil {
+            return nil, fmt.Errorf("failed to process backend_config block %w", err)
+          }
+          taskData["backend_config"] = backendConfig
+      }
+      if block.Type == "scale" {
+          scale, err := processScaleBlock(block)
+          if err != nil {
+            return nil, fmt.Errorf("failed to process scale block %w", err)
+          }
+          taskData["scale"] = scale
+      }
+      if block.Type == "lease" {
+          lease, err := processLeaseBlock(block)
+          if err != nil {
+            return nil, fmt.Errorf("failed to process lease block %w", err)
+          }
+          taskData["lease"] = lease
+      }
+      if block.Type == "flap_detection" {
+          flapDetection, err := processFlapDetectionBlock(block)
+          if err != nil {
+            return nil, fmt.Errorf("failed to process flap_detection block %w", err)
+          }
+          taskData["flap_detection"] = flapDetection
+      }
+      if block.Type == "escalation" {
+          escalation, err := processEscalationBlock(block)
+          if err != nil {
+            return nil, fmt.Errorf("failed to process escalation block %w", err)
+          }
+          taskData["escalation"] = escalation
+      }
+      if block.Type == "variables" {
+          variables, err := processExpressionBlock(block)
+          if err != nil {
+            return nil, fmt.Errorf("failed to process variables block %w", err)
+          }
+          taskData["variables"] = variables
+      }
   }
 
   return taskData, nil
@@ -234,6 +445,10 @@ func processConditionBlock(conditionBlock *hcl.Block) (map[string]interface{}, e
           {Name: "terraform_scheduling"},
           {Name: "resolved_signal"},
           {Name: "ignore_resolved"},
+          {Name: "resolved_grace_period"},
+          {Name: "targets"},
+          {Name: "replace"},
+          {Name: "refresh_only"},
       },
       Blocks: []hcl.BlockHeaderSchema{{Type: "label"}},
   })
@@ -242,6 +457,10 @@ func processConditionBlock(conditionBlock *hcl.Block) (map[string]interface{}, e
   }
 
   for k, attr := range content.Attributes {
+      if expressionAttributes[k] {
+          conditionData[k] = expressionSource(attr.Expr)
+          continue
+      }
       val, diags := attr.Expr.Value(nil)
       if diags.HasErrors() {
           log.Error("Failed to decode attribute value for %s: %s", k, diags)
@@ -289,17 +508,417 @@ func processLabelBlock(labelBlock *hcl.Block) (map[string]string, error) {
   return labels, nil
 }
 
+func processScaleBlock(scaleBlock *hcl.Block) (*ScaleConfig, error) {
+  scale := &ScaleConfig{Variable: DefaultScaleVariable, Step: 1}
+
+  content, diags := scaleBlock.Body.Content(&hcl.BodySchema{
+      Attributes: []hcl.AttributeSchema{
+          {Name: "variable"},
+          {Name: "min"},
+          {Name: "max", Required: true},
+          {Name: "step"},
+          {Name: "cooldown"},
+      },
+  })
+  if diags.HasErrors() {
+      return nil, fmt.Errorf("failed to get scale content %s", diags)
+  }
+
+  for k, attr := range content.Attributes {
+      val, diags := attr.Expr.Value(nil)
+      if diags.HasErrors() {
+          return nil, fmt.Errorf("failed to decode attribute value for %s: %s", k, diags)
+      }
+
+      switch k {
+      case "variable", "cooldown":
+          if val.Type() != cty.String {
+              return nil, fmt.Errorf("%s must be a string", k)
+          }
+          if k == "variable" {
+              scale.Variable = val.AsString()
+          } else {
+              scale.Cooldown = val.AsString()
+          }
+      default:
+          if val.Type() != cty.Number {
+              return nil, fmt.Errorf("%s must be a number", k)
+          }
+          n, _ := val.AsBigFloat().Int64()
+          switch k {
+          case "min":
+              scale.Min = int(n)
+          case "max":
+              scale.Max = int(n)
+          case "step":
+              scale.Step = int(n)
+          }
+      }
+  }
+
+  return scale, nil
+}
+
+func processLeaseBlock(leaseBlock *hcl.Block) (*LeaseConfig, error) {
+  lease := &LeaseConfig{Multiple: DefaultLeaseMultiple}
+
+  content, diags := leaseBlock.Body.Content(&hcl.BodySchema{
+      Attributes: []hcl.AttributeSchema{
+          {Name: "repeat_interval", Required: true},
+          {Name: "multiple"},
+      },
+  })
+  if diags.HasErrors() {
+      return nil, fmt.Errorf("failed to get lease content %s", diags)
+  }
+
+  for k, attr := range content.Attributes {
+      val, diags := attr.Expr.Value(nil)
+      if diags.HasErrors() {
+          return nil, fmt.Errorf("failed to decode attribute value for %s: %s", k, diags)
+      }
+
+      switch k {
+      case "repeat_interval":
+          if val.Type() != cty.String {
+              return nil, fmt.Errorf("%s must be a string", k)
+          }
+          lease.RepeatInterval = val.AsString()
+      case "multiple":
+          if val.Type() != cty.Number {
+              return nil, fmt.Errorf("%s must be a number", k)
+          }
+          n, _ := val.AsBigFloat().Int64()
+          lease.Multiple = int(n)
+      }
+  }
+
+  return lease, nil
+}
+
+func processFlapDetectionBlock(flapBlock *hcl.Block) (*FlapDetectionConfig, error) {
+  flapDetection := &FlapDetectionConfig{Threshold: DefaultFlapThreshold}
+
+  content, diags := flapBlock.Body.Content(&hcl.BodySchema{
+      Attributes: []hcl.AttributeSchema{
+          {Name: "window", Required: true},
+          {Name: "threshold"},
+      },
+  })
+  if diags.HasErrors() {
+      return nil, fmt.Errorf("failed to get flap_detection content %s", diags)
+  }
+
+  for k, attr := range content.Attributes {
+      val, diags := attr.Expr.Value(nil)
+      if diags.HasErrors() {
+          return nil, fmt.Errorf("failed to decode attribute value for %s: %s", k, diags)
+      }
+
+      switch k {
+      case "window":
+          if val.Type() != cty.String {
+              return nil, fmt.Errorf("%s must be a string", k)
+          }
+          flapDetection.Window = val.AsString()
+      case "threshold":
+          if val.Type() != cty.Number {
+              return nil, fmt.Errorf("%s must be a number", k)
+          }
+          n, _ := val.AsBigFloat().Int64()
+          flapDetection.Threshold = int(n)
+      }
+  }
+
+  return flapDetection, nil
+}
+
+func processEscalationBlock(escalationBlock *hcl.Block) (*EscalationConfig, error) {
+  escalation := &EscalationConfig{SeverityLabel: DefaultSeverityLabel}
+
+  content, diags := escalationBlock.Body.Content(&hcl.BodySchema{
+      Attributes: []hcl.AttributeSchema{
+          {Name: "severity_label"},
+          {Name: "target_labels"},
+      },
+      Blocks: []hcl.BlockHeaderSchema{
+          {Type: "step", LabelNames: []string{"severity"}},
+      },
+  })
+  if diags.HasErrors() {
+      return nil, fmt.Errorf("failed to get escalation content %s", diags)
+  }
+
+  for k, attr := range content.Attributes {
+      val, diags := attr.Expr.Value(nil)
+      if diags.HasErrors() {
+          return nil, fmt.Errorf("failed to decode attribute value for %s: %s", k, diags)
+      }
+
+      switch k {
+      case "severity_label":
+          if val.Type() != cty.String {
+              return nil, fmt.Errorf("%s must be a string", k)
+          }
+          escalation.SeverityLabel = val.AsString()
+      case "target_labels":
+          if !val.Type().IsTupleType() && !val.Type().IsListType() {
+              return nil, fmt.Errorf("%s must be a list of strings", k)
+          }
+          for it := val.ElementIterator(); it.Next(); {
+              _, v := it.Element()
+              if v.Type() != cty.String {
+                  return nil, fmt.Errorf("%s must be a list of strings", k)
+              }
+              escalation.TargetLabels = append(escalation.TargetLabels, v.AsString())
+          }
+      }
+  }
+
+  // Steps are kept in the order they're declared in, from the lowest severity to the highest
+  for _, block := range content.Blocks {
+      step := EscalationStep{Severity: block.Labels[0]}
+
+      stepContent, diags := block.Body.Content(&hcl.BodySchema{
+          Blocks: []hcl.BlockHeaderSchema{{Type: "variables"}},
+      })
+      if diags.HasErrors() {
+          return nil, fmt.Errorf("failed to get step %s content %s", step.Severity, diags)
+      }
+      for _, variablesBlock := range stepContent.Blocks {
+          variables, err := processExpressionBlock(variablesBlock)
+          if err != nil {
+            return nil, fmt.Errorf("failed to process variables block of step %s %w", step.Severity, err)
+          }
+          step.Variables = variables
+      }
+
+      escalation.Steps = append(escalation.Steps, step)
+  }
+
+  return escalation, nil
+}
+
+// taskDurations parses the durations of a task with the parser of the command it renders to,
+// so that the configuration and the commands agree on them.
+func taskDurations(task *Task) (command.Durations, error) {
+  cmd := command.Command{
+      ResolvedGracePeriod:  task.Condition.ResolvedGracePeriod,
+      ReleaseAfter:         task.ReleaseAfter,
+      ResolveDelay:         task.ResolveDelay,
+      FireDelay:            task.FireDelay,
+      CooldownAfterApply:   task.CooldownAfterApply,
+      CooldownAfterDestroy: task.CooldownAfterDestroy,
+      AggregateWindow:      task.AggregateWindow,
+  }
+  if task.Scale != nil {
+      cmd.Scale = &command.Scale{Cooldown: task.Scale.Cooldown}
+  }
+  if task.Lease != nil {
+      cmd.Lease = &command.Lease{RepeatInterval: task.Lease.RepeatInterval, Multiple: task.Lease.Multiple}
+  }
+  if task.FlapDetection != nil {
+      cmd.FlapDetection = &command.FlapDetection{Window: task.FlapDetection.Window}
+  }
+
+  err := cmd.ParseDurations()
+  return cmd.Durations, err
+}
+
+// perAlertConflict rejects a setting that works on the lifecycle of each alert for the tasks without one:
+// aggregate, scale and escalation tasks keep track of their runs in their own records.
+func perAlertConflict(task *Task, setting string) error {
+  if task.Mode == "aggregate" || task.Condition.TerraformScheduling == "scale" || task.Escalation != nil {
+      return fmt.Errorf("%s can't be combined with aggregate mode, scale scheduling or escalation", setting)
+  }
+  return nil
+}
+
+// validateTask checks the settings of a task that can't be checked while decoding them
+func validateTask(task *Task) error {
+  durations, err := taskDurations(task)
+  if err != nil {
+      return err
+  }
+
+  if task.Condition.TerraformScheduling == "scale" && task.Scale == nil {
+      return fmt.Errorf("scale scheduling requires a scale block")
+  }
+
+  if task.Scale != nil {
+      if task.Scale.Min < 0 || task.Scale.Max < task.Scale.Min {
+          return fmt.Errorf("scale bounds must satisfy 0 <= min <= max")
+      }
+      if task.Scale.Step < 1 {
+          return fmt.Errorf("scale step must be at least 1")
+      }
+  }
+
+  if task.HaltOnFailure && task.Rollout != "sequential" {
+      return fmt.Errorf("halt_on_failure requires rollout = \"sequential\", elements applied in parallel can't halt each other")
+  }
+
+  if task.ReleaseAfter != "" {
+      if task.Condition.TerraformScheduling != "sawtooth" {
+          return fmt.Errorf("release_after requires sawtooth scheduling")
+      }
+      if durations.ReleaseAfter == 0 {
+          return fmt.Errorf("release_after must be positive")
+      }
+  }
+
+  if task.ResolveDelay != "" {
+      err := perAlertConflict(task, "resolve_delay")
+      if err != nil {
+          return err
+      }
+      if task.Condition.TerraformScheduling != "" {
+          return fmt.Errorf("resolve_delay can't be combined with a terraform_scheduling mode")
+      }
+  }
+
+  if task.FireDelay != "" {
+      err := perAlertConflict(task, "fire_delay")
+      if err != nil {
+          return err
+      }
+  }
+
+  if task.Lease != nil {
+      if task.Lease.Multiple < 1 {
+          return fmt.Errorf("lease multiple must be at least 1")
+      }
+      if durations.Lease <= 0 {
+          return fmt.Errorf("lease repeat_interval must be positive")
+      }
+      err := perAlertConflict(task, "lease")
+      if err != nil {
+          return err
+      }
+  }
+
+  cooldowns := map[string]struct {
+      value    string
+      duration time.Duration
+  }{
+      "cooldown_after_apply":   {task.CooldownAfterApply, durations.CooldownAfterApply},
+      "cooldown_after_destroy": {task.CooldownAfterDestroy, durations.CooldownAfterDestroy},
+  }
+  for name, cooldown := range cooldowns {
+      if cooldown.value == "" {
+          continue
+      }
+      if cooldown.duration == 0 {
+          return fmt.Errorf("%s must be positive", name)
+      }
+      err := perAlertConflict(task, name)
+      if err != nil {
+          return err
+      }
+  }
+  if task.CooldownScope != "" && task.CooldownScope != "task" && task.CooldownScope != "fingerprint" {
+      return fmt.Errorf("cooldown_scope must be \"task\" or \"fingerprint\", got %q", task.CooldownScope)
+  }
+
+  if task.FlapDetection != nil {
+      if durations.FlapWindow == 0 {
+          return fmt.Errorf("flap_detection window must be positive")
+      }
+      if task.FlapDetection.Threshold < 2 {
+          return fmt.Errorf("flap_detection threshold must be at least 2")
+      }
+      err := perAlertConflict(task, "flap_detection")
+      if err != nil {
+          return err
+      }
+  }
+
+  if task.Escalation != nil {
+      if len(task.Escalation.Steps) == 0 {
+          return fmt.Errorf("escalation requires at least one step")
+      }
+      seen := make(map[string]bool, len(task.Escalation.Steps))
+      for _, step := range task.Escalation.Steps {
+          if seen[step.Severity] {
+              return fmt.Errorf("escalation step %s is declared more than once", step.Severity)
+          }
+          seen[step.Severity] = true
+      }
+      for _, label := range task.Escalation.TargetLabels {
+          if label == task.Escalation.SeverityLabel {
+              return fmt.Errorf("escalation target labels can't include the severity label %s", label)
+          }
+      }
+      if task.SourceTemplate != "" {
+          return fmt.Errorf("escalation requires a static source")
+      }
+      if task.Mode == "aggregate" || task.ForEach != "" || task.Condition.TerraformScheduling != "" {
+          return fmt.Errorf("escalation can't be combined with aggregate mode, for_each or a terraform_scheduling mode")
+      }
+  }
+
+  return nil
+}
+
+// processExpressionBlock returns the expression source of every attribute of a block
+func processExpressionBlock(block *hcl.Block) (map[string]string, error) {
+  expressions := make(map[string]string)
+
+  attrs, diags := block.Body.JustAttributes()
+  if diags.HasErrors() {
+      return nil, fmt.Errorf("failed to decode %s attributes %s", block.Type, diags)
+  }
+
+  for key, attr := range attrs {
+      expressions[key] = expressionSource(attr.Expr)
+  }
+
+  return expressions, nil
+}
+
 func populateTaskStruct(taskMap map[string]interface{}) *Task {
   task := &Task{
       Name:        taskMap["name"].(string),
       Description: taskMap["description"].(string),
-      Source:      taskMap["source"].(string),
   }
 
+  task.Source, _ = taskMap["source"].(string)
+  task.SourceTemplate, _ = taskMap["source_template"].(string)
+  task.AllowedSources, _ = taskMap["allowed_sources"].([]string)
+
   if terraformDriver, ok := taskMap["terraform_driver"]; ok {
       task.TerraformDriver = terraformDriver.(string)
   }
 
+  if outputsPath, ok := taskMap["outputs_path"]; ok {
+      task.OutputsPath = outputsPath.(string)
+  }
+
+  task.Targets, _ = taskMap["targets"].(string)
+  task.Replace, _ = taskMap["replace"].(string)
+  task.RefreshOnly, _ = taskMap["refresh_only"].(string)
+  task.BackendConfig, _ = taskMap["backend_config"].(map[string]string)
+  task.Variables, _ = taskMap["variables"].(map[string]string)
+  task.Workspace, _ = taskMap["workspace"].(string)
+  task.WorkingCopy, _ = taskMap["working_copy"].(bool)
+  task.SourceChecksum, _ = taskMap["source_checksum"].(string)
+  task.ForEach, _ = taskMap["for_each"].(string)
+  task.Rollout, _ = taskMap["rollout"].(string)
+  task.HaltOnFailure, _ = taskMap["halt_on_failure"].(bool)
+  task.Mode, _ = taskMap["mode"].(string)
+  task.AggregateWindow, _ = taskMap["aggregate_window"].(string)
+  task.AggregateVariable, _ = taskMap["aggregate_variable"].(string)
+  task.Scale, _ = taskMap["scale"].(*ScaleConfig)
+  task.ReleaseAfter, _ = taskMap["release_after"].(string)
+  task.Lease, _ = taskMap["lease"].(*LeaseConfig)
+  task.FlapDetection, _ = taskMap["flap_detection"].(*FlapDetectionConfig)
+  task.ResolveDelay, _ = taskMap["resolve_delay"].(string)
+  task.FireDelay, _ = taskMap["fire_delay"].(string)
+  task.CooldownAfterApply, _ = taskMap["cooldown_after_apply"].(string)
+  task.CooldownAfterDestroy, _ = taskMap["cooldown_after_destroy"].(string)
+  task.CooldownScope, _ = taskMap["cooldown_scope"].(string)
+  task.Escalation, _ = taskMap["escalation"].(*EscalationConfig)
+
   if cond, ok := taskMap["condition"].(map[string]interface{}); ok {
       task.Condition = populateConditionStruct(cond)
   }
@@ -310,17 +929,73 @@ func populateTaskStruct(taskMap map[string]interface{}) *Task {
 func populateConditionStruct(condMap map[string]interface{}) Condition {
   condition := Condition{
       NotifyOnFailure: condMap["notify_on_failure"].(bool),
-      ResolvedSignal:  condMap["resolved_signal"].(string),
       IgnoreResolved:  condMap["ignore_resolved"].(bool),
   }
+  // Commands without a resolved signal are sent command.DefaultResolvedSignal
+  condition.ResolvedSignal, _ = condMap["resolved_signal"].(string)
 
   if terraformScheduling, ok := condMap["terraform_scheduling"]; ok {
       condition.TerraformScheduling = terraformScheduling.(string)
   }
 
+  condition.ResolvedGracePeriod, _ = condMap["resolved_grace_period"].(string)
+  condition.Targets, _ = condMap["targets"].(string)
+  condition.Replace, _ = condMap["replace"].(string)
+  condition.RefreshOnly, _ = condMap["refresh_only"].(string)
+
   if labels, ok := condMap["labels"].(map[string]string); ok {
       condition.Labels = labels
   }
 
   return condition
 }
+
+// expressionSource returns the configuration source of an expression
+func expressionSource(expr hcl.Expression) string {
+  rng := expr.Range()
+  return string(rng.SliceBytes(configSources[rng.Filename]))
+}
+
+// StepVariables returns the variables of an escalation step, merged over the task variables
+func (t *Task) StepVariables(step EscalationStep) map[string]string {
+  variables := make(map[string]string, len(t.Variables)+len(step.Variables))
+  for name, src := range t.Variables {
+      variables[name] = src
+  }
+  for name, src := range step.Variables {
+      variables[name] = src
+  }
+  return variables
+}
+
+// AggregateInput returns the input variable the instances of an aggregate task are passed in
+func (t *Task) AggregateInput() string {
+  if t.AggregateVariable != "" {
+      return t.AggregateVariable
+  }
+  return DefaultAggregateVariable
+}
+
+// TerraformTargets returns the targets expression of the task, overridden by its condition
+func (t *Task) TerraformTargets() string {
+  if t.Condition.Targets != "" {
+      return t.Condition.Targets
+  }
+  return t.Targets
+}
+
+// TerraformReplace returns the replace expression of the task, overridden by its condition
+func (t *Task) TerraformReplace() string {
+  if t.Condition.Replace != "" {
+      return t.Condition.Replace
+  }
+  return t.Replace
+}
+
+// TerraformRefreshOnly returns the refresh_only expression of the task, overridden by its condition
+func (t *Task) TerraformRefreshOnly() string {
+  if t.Condition.RefreshOnly != "" {
+      return t.Condition.RefreshOnly
+  }
+  return t.RefreshOnly
+}
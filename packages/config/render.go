@@ -7,7 +7,6 @@ import (
 )
 
 var terraformDriver string
-var terraformDirArg string
 
 type YAMLConfig struct {
     ListenAddress string        `yaml:"listen_address"`
@@ -18,14 +17,44 @@ type YAMLConfig struct {
 }
 
 type InitCommand struct {
+    Task            string            `yaml:"task,omitempty"`
     Cmd             string            `yaml:"cmd"`
     Args            []string          `yaml:"args,omitempty"`
+    Source          string            `yaml:"source,omitempty"`
+    SourceTemplate  string            `yaml:"source_template,omitempty"`
+    AllowedSources  []string          `yaml:"allowed_sources,omitempty"`
     MatchLabels     map[string]string `yaml:"match_labels,omitempty"`
     NotifyOnFailure bool              `yaml:"notify_on_failure"`
     ResolvedSignal  string            `yaml:"resolved_signal,omitempty"`
     IgnoreResolved  bool              `yaml:"ignore_resolved,omitempty"`
+    ResolvedGracePeriod string        `yaml:"resolved_grace_period,omitempty"`
     Max             int               `yaml:"max,omitempty"`
   	TerraformScheduling string `yaml:"terraform_scheduling,omitempty"`
+    OutputsPath     string            `yaml:"outputs_path,omitempty"`
+    Targets         string            `yaml:"targets,omitempty"`
+    Replace         string            `yaml:"replace,omitempty"`
+    RefreshOnly     string            `yaml:"refresh_only,omitempty"`
+    BackendConfig   map[string]string `yaml:"backend_config,omitempty"`
+    Variables       map[string]string `yaml:"variables,omitempty"`
+    Workspace       string            `yaml:"workspace,omitempty"`
+    WorkingCopy     bool              `yaml:"working_copy,omitempty"`
+    SourceChecksum  string            `yaml:"source_checksum,omitempty"`
+    ForEach         string            `yaml:"for_each,omitempty"`
+    Rollout         string            `yaml:"rollout,omitempty"`
+    HaltOnFailure   bool              `yaml:"halt_on_failure,omitempty"`
+    Mode            string            `yaml:"mode,omitempty"`
+    AggregateWindow string            `yaml:"aggregate_window,omitempty"`
+    AggregateVariable string          `yaml:"aggregate_variable,omitempty"`
+    Scale           *ScaleConfig      `yaml:"scale,omitempty"`
+    Escalation      *EscalationConfig `yaml:"escalation,omitempty"`
+    ReleaseAfter    string            `yaml:"release_after,omitempty"`
+    Lease           *LeaseConfig      `yaml:"lease,omitempty"`
+    ResolveDelay    string            `yaml:"resolve_delay,omitempty"`
+    FireDelay       string            `yaml:"fire_delay,omitempty"`
+    FlapDetection   *FlapDetectionConfig `yaml:"flap_detection,omitempty"`
+    CooldownAfterApply   string       `yaml:"cooldown_after_apply,omitempty"`
+    CooldownAfterDestroy string       `yaml:"cooldown_after_destroy,omitempty"`
+    CooldownScope   string            `yaml:"cooldown_scope,omitempty"`
 }
 
 func RenderConfig(config *InitConfig, ymlConfigPath string) error {
@@ -40,22 +69,46 @@ func RenderConfig(config *InitConfig, ymlConfigPath string) error {
             if task.TerraformDriver != "" {
               terraformDriver = task.TerraformDriver
             }
-            switch {
-            case terraformDriver == "terraform":
-              terraformDirArg = "-chdir="
-            case terraformDriver == "terragrunt":
-              terraformDirArg = "--terragrunt-working-dir "
-            }
-            chDir := fmt.Sprintf("%s%s", terraformDirArg, task.Source)
+            chDir := ModuleDirArg(terraformDriver, task.Source)
             taskCmd := []string{chDir, "apply", "-auto-approve"}
             cmd := InitCommand{
+                Task:             task.Name,
                 Cmd:              terraformDriver,
                 Args:             taskCmd,
+                Source:           task.Source,
+                SourceTemplate:   task.SourceTemplate,
+                AllowedSources:   task.AllowedSources,
                 MatchLabels:      task.Condition.Labels,
                 NotifyOnFailure:  task.Condition.NotifyOnFailure,
                 ResolvedSignal:   task.Condition.ResolvedSignal,
                 IgnoreResolved:   task.Condition.IgnoreResolved,
+                ResolvedGracePeriod: task.Condition.ResolvedGracePeriod,
                 TerraformScheduling:   task.Condition.TerraformScheduling,
+                OutputsPath:      task.OutputsPath,
+                Targets:          task.TerraformTargets(),
+                Replace:          task.TerraformReplace(),
+                RefreshOnly:      task.TerraformRefreshOnly(),
+                BackendConfig:    task.BackendConfig,
+                Variables:        task.Variables,
+                Workspace:        task.Workspace,
+                WorkingCopy:      task.WorkingCopy,
+                SourceChecksum:   task.SourceChecksum,
+                ForEach:          task.ForEach,
+                Rollout:          task.Rollout,
+                HaltOnFailure:    task.HaltOnFailure,
+                Mode:             task.Mode,
+                AggregateWindow:  task.AggregateWindow,
+                AggregateVariable: task.AggregateVariable,
+                Scale:            task.Scale,
+                Escalation:       task.Escalation,
+                ReleaseAfter:     task.ReleaseAfter,
+                Lease:            task.Lease,
+                ResolveDelay:     task.ResolveDelay,
+                FireDelay:        task.FireDelay,
+                FlapDetection:    task.FlapDetection,
+                CooldownAfterApply:   task.CooldownAfterApply,
+                CooldownAfterDestroy: task.CooldownAfterDestroy,
+                CooldownScope:    task.CooldownScope,
                 Max:              1,
             }
             yamlConfig.Commands = append(yamlConfig.Commands, cmd)
@@ -68,3 +121,15 @@ func RenderConfig(config *InitConfig, ymlConfigPath string) error {
     }
     return ioutil.WriteFile(ymlConfigPath, data, 0644)
 }
+
+// ModuleDirArg returns the argument pointing a Terraform driver at a module directory
+func ModuleDirArg(terraformDriver, moduleDir string) string {
+    var terraformDirArg string
+    switch {
+    case terraformDriver == "terraform":
+      terraformDirArg = "-chdir="
+    case terraformDriver == "terragrunt":
+      terraformDirArg = "--terragrunt-working-dir "
+    }
+    return fmt.Sprintf("%s%s", terraformDirArg, moduleDir)
+}
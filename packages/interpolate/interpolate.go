@@ -0,0 +1,232 @@
+package interpolate
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/prometheus/alertmanager/template"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"github.com/zclconf/go-cty/cty/function"
+	"github.com/zclconf/go-cty/cty/function/stdlib"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// Functions available to task expressions
+var functions = map[string]function.Function{
+	"coalesce":   stdlib.CoalesceFunc,
+	"concat":     stdlib.ConcatFunc,
+	"contains":   stdlib.ContainsFunc,
+	"element":    stdlib.ElementFunc,
+	"format":     stdlib.FormatFunc,
+	"join":       stdlib.JoinFunc,
+	"jsondecode": stdlib.JSONDecodeFunc,
+	"jsonencode": stdlib.JSONEncodeFunc,
+	"keys":       stdlib.KeysFunc,
+	"length":     stdlib.LengthFunc,
+	"lookup":     stdlib.LookupFunc,
+	"lower":      stdlib.LowerFunc,
+	"merge":      stdlib.MergeFunc,
+	"regex":      stdlib.RegexFunc,
+	"replace":    stdlib.ReplaceFunc,
+	"split":      stdlib.SplitFunc,
+	"substr":     stdlib.SubstrFunc,
+	"tobool":     stdlib.MakeToFunc(cty.Bool),
+	"tolist":     stdlib.MakeToFunc(cty.List(cty.DynamicPseudoType)),
+	"tomap":      stdlib.MakeToFunc(cty.Map(cty.DynamicPseudoType)),
+	"tonumber":   stdlib.MakeToFunc(cty.Number),
+	"toset":      stdlib.MakeToFunc(cty.Set(cty.DynamicPseudoType)),
+	"tostring":   stdlib.MakeToFunc(cty.String),
+	"trimspace":  stdlib.TrimSpaceFunc,
+	"upper":      stdlib.UpperFunc,
+	"values":     stdlib.ValuesFunc,
+}
+
+// AlertValue returns the object exposed to task expressions as `alert`.
+func AlertValue(alert *template.Alert) cty.Value {
+	return cty.ObjectVal(map[string]cty.Value{
+		"status":        cty.StringVal(alert.Status),
+		"fingerprint":   cty.StringVal(alert.Fingerprint),
+		"generator_url": cty.StringVal(alert.GeneratorURL),
+		"starts_at":     cty.StringVal(timeToStr(alert.StartsAt)),
+		"ends_at":       cty.StringVal(timeToStr(alert.EndsAt)),
+		"labels":        stringMapValue(alert.Labels),
+		"annotations":   stringMapValue(alert.Annotations),
+	})
+}
+
+// EvalContext returns an evaluation context exposing the alert and the given extra variables.
+// A nil alert leaves `alert` undefined, so expressions referring to it fail to evaluate.
+func EvalContext(alert *template.Alert, vars map[string]cty.Value) *hcl.EvalContext {
+	variables := make(map[string]cty.Value, len(vars)+1)
+	for k, v := range vars {
+		variables[k] = v
+	}
+	if alert != nil {
+		variables["alert"] = AlertValue(alert)
+	}
+
+	return &hcl.EvalContext{
+		Variables: variables,
+		Functions: functions,
+	}
+}
+
+// UnknownAlertValue returns an `alert` object whose attributes are all unknown.
+// Evaluating an expression against it yields the type of its result without an actual alert.
+func UnknownAlertValue() cty.Value {
+	return cty.ObjectVal(map[string]cty.Value{
+		"status":        cty.UnknownVal(cty.String),
+		"fingerprint":   cty.UnknownVal(cty.String),
+		"generator_url": cty.UnknownVal(cty.String),
+		"starts_at":     cty.UnknownVal(cty.String),
+		"ends_at":       cty.UnknownVal(cty.String),
+		"labels":        cty.UnknownVal(cty.Map(cty.String)),
+		"annotations":   cty.UnknownVal(cty.Map(cty.String)),
+	})
+}
+
+// EachValue returns the object exposed to the expressions of a fan-out element as `each`.
+func EachValue(element string) cty.Value {
+	return cty.ObjectVal(map[string]cty.Value{
+		"key":   cty.StringVal(element),
+		"value": cty.StringVal(element),
+	})
+}
+
+// UnknownEachValue returns an `each` object whose attributes are unknown.
+func UnknownEachValue() cty.Value {
+	return cty.ObjectVal(map[string]cty.Value{
+		"key":   cty.UnknownVal(cty.String),
+		"value": cty.UnknownVal(cty.String),
+	})
+}
+
+// Value evaluates an expression source against an alert.
+func Value(src string, alert *template.Alert) (cty.Value, error) {
+	return ValueWithContext(src, EvalContext(alert, nil))
+}
+
+// ValueWithContext evaluates an expression source with the given evaluation context.
+func ValueWithContext(src string, ctx *hcl.EvalContext) (cty.Value, error) {
+	expr, diags := hclsyntax.ParseExpression([]byte(src), "expression", hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		return cty.NilVal, fmt.Errorf("failed to parse expression %s: %s", src, diags)
+	}
+
+	val, diags := expr.Value(ctx)
+	if diags.HasErrors() {
+		return cty.NilVal, fmt.Errorf("failed to evaluate expression %s: %s", src, diags)
+	}
+
+	return val, nil
+}
+
+// String evaluates an expression source to a string.
+func String(src string, alert *template.Alert) (string, error) {
+	val, err := Value(src, alert)
+	if err != nil {
+		return "", err
+	}
+	return AsString(val)
+}
+
+// Strings evaluates an expression source to a list of strings.
+func Strings(src string, alert *template.Alert) ([]string, error) {
+	val, err := Value(src, alert)
+	if err != nil {
+		return nil, err
+	}
+	return AsStrings(val)
+}
+
+// Bool evaluates an expression source to a bool.
+func Bool(src string, alert *template.Alert) (bool, error) {
+	val, err := Value(src, alert)
+	if err != nil {
+		return false, err
+	}
+
+	b, err := AsBool(val)
+	if err != nil {
+		return false, fmt.Errorf("expression %s is not a bool", src)
+	}
+
+	return b, nil
+}
+
+// AsBool converts a value to a bool.
+func AsBool(val cty.Value) (bool, error) {
+	val, err := convert.Convert(val, cty.Bool)
+	if err != nil {
+		return false, err
+	}
+	if val.IsNull() || !val.IsKnown() {
+		return false, fmt.Errorf("value is not a known bool")
+	}
+	return val.True(), nil
+}
+
+// AsString converts a value to a string.
+func AsString(val cty.Value) (string, error) {
+	val, err := convert.Convert(val, cty.String)
+	if err != nil {
+		return "", err
+	}
+	if val.IsNull() || !val.IsKnown() {
+		return "", fmt.Errorf("value is not a known string")
+	}
+	return val.AsString(), nil
+}
+
+// AsStrings converts a list, set or tuple value to a list of strings.
+func AsStrings(val cty.Value) ([]string, error) {
+	if val.IsNull() {
+		return nil, nil
+	}
+	if !val.IsKnown() || !val.CanIterateElements() {
+		return nil, fmt.Errorf("value is not a list")
+	}
+
+	var strs []string
+	for it := val.ElementIterator(); it.Next(); {
+		_, v := it.Element()
+		s, err := AsString(v)
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, s)
+	}
+
+	return strs, nil
+}
+
+// JSON converts a value to JSON, keeping its type: numbers, bools, lists and maps are preserved.
+func JSON(val cty.Value) ([]byte, error) {
+	if !val.IsWhollyKnown() {
+		return nil, fmt.Errorf("value is not known")
+	}
+	return ctyjson.SimpleJSONValue{Value: val}.MarshalJSON()
+}
+
+func stringMapValue(m map[string]string) cty.Value {
+	if len(m) == 0 {
+		return cty.MapValEmpty(cty.String)
+	}
+
+	vals := make(map[string]cty.Value, len(m))
+	for k, v := range m {
+		vals[k] = cty.StringVal(v)
+	}
+	return cty.MapVal(vals)
+}
+
+// timeToStr converts a time into an RFC3339 string, or an empty string when unset.
+func timeToStr(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,102 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/cloudputation/iterator/packages/storage"
+	"github.com/cloudputation/iterator/packages/terraform"
+)
+
+// Instance is a firing alert of an aggregate task, or of the target of an escalation ladder.
+type Instance struct {
+	Fingerprint string            `json:"fingerprint"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    string            `json:"starts_at"`
+}
+
+// Aggregate is the record Iterator keeps for an aggregate task:
+// the set of its firing instances, and the run that applied them.
+type Aggregate struct {
+	Task            string              `json:"task"`
+	Instances       map[string]Instance `json:"instances"`
+	Module          string              `json:"module"`
+	TerraformDriver string              `json:"terraform_driver"`
+	// Generation is bumped on every change to the set of instances,
+	// AppliedGeneration is the generation of the last successful run.
+	Generation        int `json:"generation"`
+	AppliedGeneration int `json:"applied_generation"`
+	// Whether an apply ran, even a failed one, so the module may have resources to destroy
+	Applied bool `json:"applied"`
+	terraform.Options
+}
+
+// Pending returns true if the set of instances changed since the last successful run.
+func (a *Aggregate) Pending() bool {
+	return a.Generation != a.AppliedGeneration
+}
+
+// InstanceList returns the instances of the aggregate, sorted by fingerprint.
+func (a *Aggregate) InstanceList() []Instance {
+	instances := make([]Instance, 0, len(a.Instances))
+	for _, instance := range a.Instances {
+		instances = append(instances, instance)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Fingerprint < instances[j].Fingerprint })
+	return instances
+}
+
+// ReadAggregate returns the record of an aggregate task.
+func ReadAggregate(taskName string) (*Aggregate, error) {
+	data, err := storage.StoreGet(storage.AggregatesNamespace, taskName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve aggregate data for %s: %v", taskName, err)
+	}
+
+	var aggregate Aggregate
+	err = json.Unmarshal(data, &aggregate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal aggregate data: %v", err)
+	}
+	if aggregate.Instances == nil {
+		aggregate.Instances = make(map[string]Instance)
+	}
+
+	return &aggregate, nil
+}
+
+// WriteAggregate stores the record of an aggregate task.
+func WriteAggregate(aggregate *Aggregate) error {
+	data, err := json.MarshalIndent(aggregate, "", "    ")
+	if err != nil {
+		return fmt.Errorf("Error marshaling aggregate data: %w", err)
+	}
+
+	return storage.StorePut(storage.AggregatesNamespace, aggregate.Task, data)
+}
+
+// DeleteAggregate removes the record of an aggregate task.
+func DeleteAggregate(taskName string) error {
+	return storage.StoreDelete(storage.AggregatesNamespace, taskName)
+}
+
+// ListAggregates returns the records of all aggregate tasks.
+func ListAggregates() ([]*Aggregate, error) {
+	keys, err := storage.StoreList(storage.AggregatesNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var aggregates []*Aggregate
+	for _, key := range keys {
+		aggregate, err := ReadAggregate(key)
+		if err != nil {
+			continue
+		}
+		aggregates = append(aggregates, aggregate)
+	}
+
+	return aggregates, nil
+}
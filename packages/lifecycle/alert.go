@@ -0,0 +1,237 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloudputation/iterator/packages/config"
+	log "github.com/cloudputation/iterator/packages/logger"
+	"github.com/cloudputation/iterator/packages/storage"
+	"github.com/cloudputation/iterator/packages/terraform"
+)
+
+// Alert is the record Iterator keeps for every alert a task ran for.
+type Alert struct {
+	Fingerprint         string          `json:"fingerprint"`
+	AlertName           string          `json:"alert_name,omitempty"`
+	Task                string          `json:"task,omitempty"`
+	Module              string          `json:"module"`
+	TerraformDriver     string          `json:"terraform_driver"`
+	TerraformScheduling string          `json:"terraform_scheduling"`
+	Outputs             json.RawMessage `json:"outputs,omitempty"`
+	// Commit of the git source the module was applied from
+	Commit string `json:"commit,omitempty"`
+	// Integrity violation that prevented the module from being run
+	IntegrityError string `json:"integrity_error,omitempty"`
+	// Runs of a fan-out task, one per element
+	Elements []Element `json:"elements,omitempty"`
+	// When a sawtooth deployment is released, if it has a time-to-live
+	ReleaseAt *time.Time `json:"release_at,omitempty"`
+	// Labels of the alert, and when it is considered resolved if no firing notification renews its lease
+	Labels         map[string]string `json:"labels,omitempty"`
+	LeaseExpiresAt *time.Time        `json:"lease_expires_at,omitempty"`
+	// When the resources of a resolved alert are destroyed, unless it fires again before
+	DestroyAt *time.Time `json:"destroy_at,omitempty"`
+	terraform.Options
+}
+
+// Results of the run of a fan-out element
+const (
+	ElementOk      = "ok"
+	ElementFailed  = "failed"
+	ElementSkipped = "skipped"
+)
+
+// Element is the run of a fan-out task for one of its elements.
+type Element struct {
+	Value   string          `json:"value"`
+	Module  string          `json:"module,omitempty"`
+	Result  string          `json:"result"`
+	Error   string          `json:"error,omitempty"`
+	Outputs json.RawMessage `json:"outputs,omitempty"`
+	terraform.Options
+}
+
+// AlertKey returns the key an alert record is stored under.
+// Consul records are keyed by alert name so that they can be watched by CTS,
+// file records are keyed by fingerprint.
+func AlertKey(alertName, fingerprint string) string {
+	if config.ConsulStorageEnabled {
+		return alertName
+	}
+	return fingerprint
+}
+
+// ReadAlert returns the alert record stored under key.
+func ReadAlert(key string) (*Alert, error) {
+	data, err := storage.StoreGet(storage.AlertsNamespace, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve alert data for %s: %v", key, err)
+	}
+
+	var alert Alert
+	err = json.Unmarshal(data, &alert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal alert data: %v", err)
+	}
+
+	return &alert, nil
+}
+
+// WriteAlert stores the alert record under key.
+func WriteAlert(key string, alert *Alert) error {
+	data, err := json.MarshalIndent(alert, "", "    ")
+	if err != nil {
+		return fmt.Errorf("Error marshaling fingerprint data: %w", err)
+	}
+
+	return storage.StorePut(storage.AlertsNamespace, key, data)
+}
+
+// DeleteAlert removes the alert record stored under key.
+func DeleteAlert(key string) error {
+	return storage.StoreDelete(storage.AlertsNamespace, key)
+}
+
+// VerifyAlert checks the modules of an alert record against their pinned checksums.
+func VerifyAlert(alert *Alert) error {
+	if len(alert.Elements) == 0 {
+		return terraform.VerifyModule(alert.Module, alert.Checksum)
+	}
+
+	for _, element := range alert.Elements {
+		if element.Result == ElementSkipped {
+			continue
+		}
+		err := terraform.VerifyModule(element.Module, element.Checksum)
+		if err != nil {
+			return fmt.Errorf("element %s: %w", element.Value, err)
+		}
+	}
+
+	return nil
+}
+
+// DestroyAlert destroys the resources applied for an alert record.
+// The elements of a fan-out are destroyed one after the other, in the reverse order they were applied.
+func DestroyAlert(terraformDriver string, alert *Alert) error {
+	if len(alert.Elements) == 0 {
+		return terraform.DestroyModule(terraformDriver, alert.Module, alert.Options)
+	}
+
+	var firstErr error
+	var failed []string
+	for i := len(alert.Elements) - 1; i >= 0; i-- {
+		element := alert.Elements[i]
+		if element.Result == ElementSkipped {
+			continue
+		}
+
+		err := terraform.DestroyModule(terraformDriver, element.Module, element.Options)
+		if err != nil {
+			log.Error("Failed to destroy element %s of alert %s: %v", element.Value, alert.AlertName, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed = append(failed, element.Value)
+		}
+	}
+
+	if firstErr != nil {
+		return fmt.Errorf("failed to destroy elements %s: %w", strings.Join(failed, ", "), firstErr)
+	}
+
+	return nil
+}
+
+// RestoreAlert re-applies the resources destroyed for an alert record of an inverse command.
+// The elements of a fan-out are restored in the order they were destroyed in.
+func RestoreAlert(terraformDriver string, alert *Alert) error {
+	if len(alert.Elements) == 0 {
+		return terraform.RestoreModule(terraformDriver, alert.Module, alert.Options)
+	}
+
+	var firstErr error
+	var failed []string
+	for _, element := range alert.Elements {
+		if element.Result == ElementSkipped {
+			continue
+		}
+
+		err := terraform.RestoreModule(terraformDriver, element.Module, element.Options)
+		if err != nil {
+			log.Error("Failed to restore element %s of alert %s: %v", element.Value, alert.AlertName, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed = append(failed, element.Value)
+		}
+	}
+
+	if firstErr != nil {
+		return fmt.Errorf("failed to restore elements %s: %w", strings.Join(failed, ", "), firstErr)
+	}
+
+	return nil
+}
+
+// DiscardAlert deletes the files Iterator keeps for the runs of an alert record that is dropped
+// without its resources being destroyed, like working copies.
+func DiscardAlert(alert *Alert) {
+	if len(alert.Elements) == 0 {
+		terraform.DiscardRun(alert.Module, alert.Options)
+		return
+	}
+
+	for _, element := range alert.Elements {
+		if element.Result != ElementSkipped {
+			terraform.DiscardRun(element.Module, element.Options)
+		}
+	}
+}
+
+// ListAlerts returns all alert records, indexed by the key they're stored under.
+func ListAlerts() (map[string]*Alert, error) {
+	keys, err := storage.StoreList(storage.AlertsNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	alerts := make(map[string]*Alert, len(keys))
+	for _, key := range keys {
+		alert, err := ReadAlert(key)
+		if err != nil {
+			continue
+		}
+		alerts[key] = alert
+	}
+
+	return alerts, nil
+}
+
+// FindAlert returns the alert record matching a fingerprint.
+func FindAlert(fingerprint string) (*Alert, error) {
+	alert, err := ReadAlert(fingerprint)
+	if err == nil && alert.Fingerprint == fingerprint {
+		return alert, nil
+	}
+
+	keys, err := storage.StoreList(storage.AlertsNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		alert, err := ReadAlert(key)
+		if err != nil {
+			continue
+		}
+		if alert.Fingerprint == fingerprint {
+			return alert, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no alert found for fingerprint: %s", fingerprint)
+}
@@ -0,0 +1,58 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cloudputation/iterator/packages/storage"
+)
+
+// Cooldown holds back the firing alerts of a task until Until, after it ran Operation.
+// The cooldown of a task scoped to fingerprints only holds back Fingerprint.
+type Cooldown struct {
+	Task        string    `json:"task"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Operation   string    `json:"operation"`
+	Until       time.Time `json:"until"`
+}
+
+// CooldownKey returns the key the cooldown of a task is stored under,
+// for a single fingerprint unless fingerprint is empty.
+func CooldownKey(taskName, fingerprint string) string {
+	if fingerprint == "" {
+		return taskName
+	}
+	return taskName + "-" + fingerprint
+}
+
+// ReadCooldown returns the cooldown stored under key.
+func ReadCooldown(key string) (*Cooldown, error) {
+	data, err := storage.StoreGet(storage.CooldownsNamespace, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve cooldown data for %s: %v", key, err)
+	}
+
+	var cooldown Cooldown
+	err = json.Unmarshal(data, &cooldown)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cooldown data: %v", err)
+	}
+
+	return &cooldown, nil
+}
+
+// WriteCooldown stores a cooldown under key.
+func WriteCooldown(key string, cooldown *Cooldown) error {
+	data, err := json.MarshalIndent(cooldown, "", "    ")
+	if err != nil {
+		return fmt.Errorf("Error marshaling cooldown data: %w", err)
+	}
+
+	return storage.StorePut(storage.CooldownsNamespace, key, data)
+}
+
+// DeleteCooldown removes the cooldown stored under key.
+func DeleteCooldown(key string) error {
+	return storage.StoreDelete(storage.CooldownsNamespace, key)
+}
@@ -0,0 +1,63 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/cloudputation/iterator/packages/storage"
+	"github.com/cloudputation/iterator/packages/terraform"
+)
+
+// Escalation is the record Iterator keeps for a target of an escalating task:
+// the alert firing for each of its severities, and the step its module was last applied with.
+type Escalation struct {
+	Task   string            `json:"task"`
+	Target string            `json:"target"`
+	Labels map[string]string `json:"labels"`
+	// Firing alerts of the target, indexed by severity
+	Severities map[string]Instance `json:"severities"`
+	// Severity of the step the module was applied with, empty when it has no resources
+	Step            string `json:"step,omitempty"`
+	Module          string `json:"module,omitempty"`
+	TerraformDriver string `json:"terraform_driver,omitempty"`
+	terraform.Options
+}
+
+// EscalationKey returns the key of the record of a target of an escalating task.
+func EscalationKey(taskName, target string) string {
+	return taskName + "-" + target
+}
+
+// ReadEscalation returns the record of a target of an escalating task.
+func ReadEscalation(key string) (*Escalation, error) {
+	data, err := storage.StoreGet(storage.EscalationsNamespace, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve escalation data for %s: %v", key, err)
+	}
+
+	var escalation Escalation
+	err = json.Unmarshal(data, &escalation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal escalation data: %v", err)
+	}
+	if escalation.Severities == nil {
+		escalation.Severities = make(map[string]Instance)
+	}
+
+	return &escalation, nil
+}
+
+// WriteEscalation stores the record of a target of an escalating task.
+func WriteEscalation(key string, escalation *Escalation) error {
+	data, err := json.MarshalIndent(escalation, "", "    ")
+	if err != nil {
+		return fmt.Errorf("Error marshaling escalation data: %w", err)
+	}
+
+	return storage.StorePut(storage.EscalationsNamespace, key, data)
+}
+
+// DeleteEscalation removes the record of a target of an escalating task.
+func DeleteEscalation(key string) error {
+	return storage.StoreDelete(storage.EscalationsNamespace, key)
+}
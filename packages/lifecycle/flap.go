@@ -0,0 +1,108 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cloudputation/iterator/packages/storage"
+)
+
+// Flap tracks the fire and resolve transitions of an alert for a task detecting flapping.
+// While SuspendedAt is set, the task doesn't apply or destroy anything for the alert.
+type Flap struct {
+	Task        string      `json:"task"`
+	AlertName   string      `json:"alert_name"`
+	Fingerprint string      `json:"fingerprint"`
+	Status      string      `json:"status"`
+	Transitions []time.Time `json:"transitions"`
+	SuspendedAt *time.Time  `json:"suspended_at,omitempty"`
+}
+
+// FlapKey returns the key the transitions of an alert for a task are stored under.
+func FlapKey(taskName, fingerprint string) string {
+	return taskName + "-" + fingerprint
+}
+
+// Record registers a notification of the alert with the given status.
+// It returns true if the status changed, in which case the transition is counted.
+func (f *Flap) Record(status string, at time.Time) bool {
+	if status == f.Status {
+		return false
+	}
+
+	f.Status = status
+	f.Transitions = append(f.Transitions, at)
+	return true
+}
+
+// Prune drops the transitions that left the sliding window, and returns how many remain.
+func (f *Flap) Prune(now time.Time, window time.Duration) int {
+	start := 0
+	for start < len(f.Transitions) && !f.Transitions[start].After(now.Add(-window)) {
+		start++
+	}
+	f.Transitions = f.Transitions[start:]
+
+	return len(f.Transitions)
+}
+
+// SubsidesAt returns when fewer than threshold transitions remain within the window,
+// provided no new transition happens in the meantime.
+func (f *Flap) SubsidesAt(window time.Duration, threshold int) time.Time {
+	if len(f.Transitions) < threshold {
+		return time.Time{}
+	}
+
+	return f.Transitions[len(f.Transitions)-threshold].Add(window)
+}
+
+// ReadFlap returns the flap record stored under key.
+func ReadFlap(key string) (*Flap, error) {
+	data, err := storage.StoreGet(storage.FlapsNamespace, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve flap data for %s: %v", key, err)
+	}
+
+	var flap Flap
+	err = json.Unmarshal(data, &flap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal flap data: %v", err)
+	}
+
+	return &flap, nil
+}
+
+// WriteFlap stores a flap record under key.
+func WriteFlap(key string, flap *Flap) error {
+	data, err := json.MarshalIndent(flap, "", "    ")
+	if err != nil {
+		return fmt.Errorf("Error marshaling flap data: %w", err)
+	}
+
+	return storage.StorePut(storage.FlapsNamespace, key, data)
+}
+
+// DeleteFlap removes the flap record stored under key.
+func DeleteFlap(key string) error {
+	return storage.StoreDelete(storage.FlapsNamespace, key)
+}
+
+// ListFlaps returns all flap records, indexed by the key they're stored under.
+func ListFlaps() (map[string]*Flap, error) {
+	keys, err := storage.StoreList(storage.FlapsNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	flaps := make(map[string]*Flap, len(keys))
+	for _, key := range keys {
+		flap, err := ReadFlap(key)
+		if err != nil {
+			continue
+		}
+		flaps[key] = flap
+	}
+
+	return flaps, nil
+}
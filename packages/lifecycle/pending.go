@@ -0,0 +1,75 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+
+	"github.com/cloudputation/iterator/packages/storage"
+)
+
+// PendingAlert is a firing alert parked until the fire delay of a task elapses.
+// The alert is applied at FireAt, unless it resolves before.
+type PendingAlert struct {
+	Task        string         `json:"task"`
+	Fingerprint string         `json:"fingerprint"`
+	FireAt      time.Time      `json:"fire_at"`
+	Alert       template.Alert `json:"alert"`
+}
+
+// PendingKey returns the key a pending alert of a task is stored under.
+func PendingKey(taskName, fingerprint string) string {
+	return taskName + "-" + fingerprint
+}
+
+// ReadPending returns the pending alert stored under key.
+func ReadPending(key string) (*PendingAlert, error) {
+	data, err := storage.StoreGet(storage.PendingNamespace, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve pending alert data for %s: %v", key, err)
+	}
+
+	var pending PendingAlert
+	err = json.Unmarshal(data, &pending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pending alert data: %v", err)
+	}
+
+	return &pending, nil
+}
+
+// WritePending stores a pending alert under key.
+func WritePending(key string, pending *PendingAlert) error {
+	data, err := json.MarshalIndent(pending, "", "    ")
+	if err != nil {
+		return fmt.Errorf("Error marshaling pending alert data: %w", err)
+	}
+
+	return storage.StorePut(storage.PendingNamespace, key, data)
+}
+
+// DeletePending removes the pending alert stored under key.
+func DeletePending(key string) error {
+	return storage.StoreDelete(storage.PendingNamespace, key)
+}
+
+// ListPending returns all pending alerts, indexed by the key they're stored under.
+func ListPending() (map[string]*PendingAlert, error) {
+	keys, err := storage.StoreList(storage.PendingNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make(map[string]*PendingAlert, len(keys))
+	for _, key := range keys {
+		p, err := ReadPending(key)
+		if err != nil {
+			continue
+		}
+		pending[key] = p
+	}
+
+	return pending, nil
+}
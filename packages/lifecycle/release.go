@@ -1,65 +1,71 @@
 package lifecycle
 
 import (
-	"encoding/json"
 	"fmt"
-	"os"
-	"path/filepath"
 
 	"github.com/cloudputation/iterator/packages/config"
-	"github.com/cloudputation/iterator/packages/consul"
 	log "github.com/cloudputation/iterator/packages/logger"
-	"github.com/cloudputation/iterator/packages/terraform"
 )
 
-type Alert struct {
-	Fingerprint        string `json:"fingerprint"`
-	Module             string `json:"module"`
-	TerraformScheduling string `json:"terraform_scheduling"`
+// HandleRelease releases the resources an alert left behind according to its scheduling mode:
+// sawtooth resources are destroyed, and inverse resources are restored.
+func HandleRelease(cfg *config.InitConfig, alertName string) error {
+	alert, err := ReadAlert(alertName)
+	if err != nil {
+		return err
+	}
+
+	switch alert.TerraformScheduling {
+	case "sawtooth":
+		return HandleSawtoothScheduling(cfg, alertName, alert)
+	case "inverse":
+		return HandleInverseScheduling(cfg, alertName, alert)
+	}
+
+	return nil
 }
 
-func HandleSawtoothScheduling(cfg *config.InitConfig, alertName string) error {
-	var alertData []byte
-	var err error
-	var alertPath = fmt.Sprintf("%s/process/alerts/%s", config.ConsulFactoryDataDir, alertName)
+func HandleSawtoothScheduling(cfg *config.InitConfig, alertName string, alert *Alert) error {
+	terraformDriver := releaseDriver(cfg, alert)
 
-	switch {
-	case config.ConsulStorageEnabled:
-		alertData, err = consul.ConsulStoreGet(alertPath)
-		if err != nil {
-			return fmt.Errorf("failed to retrieve alert data for %s from Consul: %v", alertName, err)
-		}
-	default:
-		dataDir := cfg.Server.DataDir
-		executorDir := fmt.Sprintf("%s/process/alerts", dataDir)
-		filePath := filepath.Join(executorDir, fmt.Sprintf("%s.json", alertName))
-		alertData, err = os.ReadFile(filePath)
-		if err != nil {
-			return fmt.Errorf("failed to retrieve alert data for %s from file system: %v", alertName, err)
-		}
+	log.Info("Sawtooth scheduling detected for alert: %s. Triggering Terraform destroy for module: %s", alertName, alert.Module)
+	err := DestroyAlert(terraformDriver, alert)
+	if err != nil {
+		return fmt.Errorf("failed to destroy terraform resource for alert: %s on module: %s: %w", alertName, alert.Module, err)
 	}
+	log.Info("Terraform destroy successful for alert: %s on module: %s", alertName, alert.Module)
 
-	var alert Alert
-	err = json.Unmarshal(alertData, &alert)
+	err = DeleteAlert(alertName)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal alert data: %v", err)
+		return fmt.Errorf("failed to delete alert data for %s: %v", alertName, err)
 	}
 
-	if alert.TerraformScheduling == "sawtooth" {
-		terraformDriver := cfg.Server.TerraformDriver
+	return nil
+}
+
+// HandleInverseScheduling restores the resources an inverse command destroyed for an alert.
+func HandleInverseScheduling(cfg *config.InitConfig, alertName string, alert *Alert) error {
+	terraformDriver := releaseDriver(cfg, alert)
 
-		log.Info("Sawtooth scheduling detected for alert: %s. Triggering Terraform destroy for module: %s", alertName, alert.Module)
-		err := terraform.RunTerraform(terraformDriver, alert.Module, "destroy")
-		if err != nil {
-			return fmt.Errorf("failed to destroy terraform resource for alert: %s on module: %s: %v", alertName, alert.Module, err)
-		}
-		log.Info("Terraform destroy successful for alert: %s on module: %s", alertName, alert.Module)
+	log.Info("Inverse scheduling detected for alert: %s. Triggering Terraform apply for module: %s", alertName, alert.Module)
+	err := RestoreAlert(terraformDriver, alert)
+	if err != nil {
+		return fmt.Errorf("failed to restore terraform resource for alert: %s on module: %s: %w", alertName, alert.Module, err)
+	}
+	log.Info("Terraform apply successful for alert: %s on module: %s", alertName, alert.Module)
 
-		err = consul.ConsulStoreDelete(alertPath)
-		if err != nil {
-			return fmt.Errorf("failed to delete alert data for %s from Consul: %v", alertName, err)
-		}
+	err = DeleteAlert(alertName)
+	if err != nil {
+		return fmt.Errorf("failed to delete alert data for %s: %v", alertName, err)
 	}
+	DiscardAlert(alert)
 
 	return nil
 }
+
+func releaseDriver(cfg *config.InitConfig, alert *Alert) string {
+	if alert.TerraformDriver != "" {
+		return alert.TerraformDriver
+	}
+	return cfg.Server.TerraformDriver
+}
@@ -0,0 +1,99 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cloudputation/iterator/packages/storage"
+	"github.com/cloudputation/iterator/packages/terraform"
+)
+
+// Scale is the record Iterator keeps for a task using the scale scheduling mode:
+// the fingerprints counted for it, and the counter value the module was last applied with.
+type Scale struct {
+	Task   string          `json:"task"`
+	Active map[string]bool `json:"active"`
+	Count  int             `json:"count"`
+	// When the counter was last stepped
+	LastStep time.Time `json:"last_step,omitempty"`
+	// The module and options of the run that applied the counter
+	Module          string `json:"module,omitempty"`
+	TerraformDriver string `json:"terraform_driver,omitempty"`
+	terraform.Options
+}
+
+// Target returns the counter value the task is converging to,
+// a step per active fingerprint above min, bounded by max.
+func (s *Scale) Target(min, max, step int) int {
+	target := min + step*len(s.Active)
+	if target > max {
+		return max
+	}
+	return target
+}
+
+// Next returns the counter value of the next step towards the target.
+func (s *Scale) Next(target, step int) int {
+	switch {
+	case s.Count < target:
+		if s.Count+step > target {
+			return target
+		}
+		return s.Count + step
+	case s.Count > target:
+		if s.Count-step < target {
+			return target
+		}
+		return s.Count - step
+	}
+	return s.Count
+}
+
+// ReadScale returns the record of a scale task.
+func ReadScale(taskName string) (*Scale, error) {
+	data, err := storage.StoreGet(storage.ScalesNamespace, taskName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve scale data for %s: %v", taskName, err)
+	}
+
+	var scale Scale
+	err = json.Unmarshal(data, &scale)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal scale data: %v", err)
+	}
+	if scale.Active == nil {
+		scale.Active = make(map[string]bool)
+	}
+
+	return &scale, nil
+}
+
+// WriteScale stores the record of a scale task.
+func WriteScale(scale *Scale) error {
+	data, err := json.MarshalIndent(scale, "", "    ")
+	if err != nil {
+		return fmt.Errorf("Error marshaling scale data: %w", err)
+	}
+
+	return storage.StorePut(storage.ScalesNamespace, scale.Task, data)
+}
+
+// ListScales returns the records of all scale tasks.
+func ListScales() ([]*Scale, error) {
+	keys, err := storage.StoreList(storage.ScalesNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var scales []*Scale
+	for _, key := range keys {
+		scale, err := ReadScale(key)
+		if err != nil {
+			continue
+		}
+		scales = append(scales, scale)
+	}
+
+	return scales, nil
+}
@@ -0,0 +1,177 @@
+package lifecycle
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudputation/iterator/packages/storage"
+)
+
+// State is a step of the lifecycle of an alert for a task.
+type State string
+
+const (
+	// The alert is parked until its fire delay elapses
+	StatePending State = "pending"
+	// The module is being applied, or restored by an inverse task
+	StateApplying State = "applying"
+	StateApplied  State = "applied"
+	// The module is being destroyed, on resolve or by an inverse task firing
+	StateDestroying State = "destroying"
+	StateDestroyed  State = "destroyed"
+	// The last run of the module failed, or was interrupted
+	StateFailed State = "failed"
+	// The alert resolved before the module was applied, or while it was
+	StateCancelled State = "cancelled"
+	// The deployment was released by an operator or its time-to-live
+	StateReleased State = "released"
+)
+
+// How many transitions are kept in the history of a lifecycle
+const maxStateHistory = 20
+
+// stateTransitions lists the states each state may move to.
+// An alert without a lifecycle starts from the empty state.
+var stateTransitions = map[State][]State{
+	"":              {StatePending, StateApplying, StateDestroying},
+	StatePending:    {StateApplying, StateDestroying, StateCancelled},
+	StateApplying:   {StateApplied, StateFailed, StateCancelled},
+	StateApplied:    {StateApplying, StateDestroying, StateReleased},
+	StateDestroying: {StateDestroyed, StateFailed, StateCancelled},
+	StateDestroyed:  {StatePending, StateApplying, StateDestroying, StateReleased},
+	StateFailed:     {StatePending, StateApplying, StateDestroying, StateReleased},
+	StateCancelled:  {StatePending, StateApplying, StateDestroying},
+	StateReleased:   {StatePending, StateApplying, StateDestroying},
+}
+
+// CanTransition returns true if a lifecycle in state from may move to state to.
+func CanTransition(from, to State) bool {
+	for _, next := range stateTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// InProgress returns true if a run of the module is under way in this state.
+func (s State) InProgress() bool {
+	return s == StateApplying || s == StateDestroying
+}
+
+// StateTransition is a change of state of a lifecycle, and why it happened.
+type StateTransition struct {
+	From   State     `json:"from,omitempty"`
+	To     State     `json:"to"`
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Lifecycle is the state of an alert for a task, with its latest transitions.
+type Lifecycle struct {
+	Task        string            `json:"task"`
+	AlertName   string            `json:"alert_name"`
+	Fingerprint string            `json:"fingerprint"`
+	State       State             `json:"state"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	History     []StateTransition `json:"history"`
+}
+
+// Serializes the read-modify-write of lifecycles
+var lifecycleMutex sync.Mutex
+
+// LifecycleKey returns the key the lifecycle of an alert for a task is stored under.
+func LifecycleKey(taskName, fingerprint string) string {
+	return taskName + "-" + fingerprint
+}
+
+// Transition moves the lifecycle of an alert for a task to a new state, and persists it.
+// Transitions the state machine doesn't allow are refused, leaving the lifecycle as it was.
+func Transition(taskName, alertName, fingerprint string, to State, reason string) (*Lifecycle, error) {
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+
+	key := LifecycleKey(taskName, fingerprint)
+	lc, err := ReadLifecycle(key)
+	if err != nil {
+		lc = &Lifecycle{Task: taskName, AlertName: alertName, Fingerprint: fingerprint}
+	}
+
+	if !CanTransition(lc.State, to) {
+		return lc, fmt.Errorf("invalid transition of %s from %q to %q", key, lc.State, to)
+	}
+
+	now := time.Now().UTC()
+	lc.History = append(lc.History, StateTransition{From: lc.State, To: to, At: now, Reason: reason})
+	if len(lc.History) > maxStateHistory {
+		lc.History = lc.History[len(lc.History)-maxStateHistory:]
+	}
+	lc.State = to
+	lc.UpdatedAt = now
+	if alertName != "" {
+		lc.AlertName = alertName
+	}
+
+	err = WriteLifecycle(key, lc)
+	if err != nil {
+		return lc, err
+	}
+
+	return lc, nil
+}
+
+// CurrentState returns the state of an alert for a task, empty if it has no lifecycle.
+func CurrentState(taskName, fingerprint string) State {
+	lc, err := ReadLifecycle(LifecycleKey(taskName, fingerprint))
+	if err != nil {
+		return ""
+	}
+	return lc.State
+}
+
+// ReadLifecycle returns the lifecycle stored under key.
+func ReadLifecycle(key string) (*Lifecycle, error) {
+	data, err := storage.StoreGet(storage.StatesNamespace, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve lifecycle data for %s: %v", key, err)
+	}
+
+	var lc Lifecycle
+	err = json.Unmarshal(data, &lc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal lifecycle data: %v", err)
+	}
+
+	return &lc, nil
+}
+
+// WriteLifecycle stores a lifecycle under key.
+func WriteLifecycle(key string, lc *Lifecycle) error {
+	data, err := json.MarshalIndent(lc, "", "    ")
+	if err != nil {
+		return fmt.Errorf("Error marshaling lifecycle data: %w", err)
+	}
+
+	return storage.StorePut(storage.StatesNamespace, key, data)
+}
+
+// ListLifecycles returns all lifecycles, indexed by the key they're stored under.
+func ListLifecycles() (map[string]*Lifecycle, error) {
+	keys, err := storage.StoreList(storage.StatesNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	lifecycles := make(map[string]*Lifecycle, len(keys))
+	for _, key := range keys {
+		lc, err := ReadLifecycle(key)
+		if err != nil {
+			continue
+		}
+		lifecycles[key] = lc
+	}
+
+	return lifecycles, nil
+}
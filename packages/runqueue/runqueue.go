@@ -0,0 +1,57 @@
+package runqueue
+
+import (
+	"sync"
+)
+
+// Queue serializes the work done for unique keys.
+// Work queued under a key runs once all the work queued before it under the same key is done,
+// in the order it was queued.
+type Queue struct {
+	mu sync.Mutex
+	// Channel closed once the last work queued under a key is done
+	tails map[string]chan struct{}
+}
+
+// Ticket is the place of some work in the queue of a key.
+type Ticket struct {
+	q    *Queue
+	key  string
+	prev chan struct{}
+	done chan struct{}
+}
+
+// NewQueue returns an empty queue
+func NewQueue() *Queue {
+	return &Queue{tails: make(map[string]chan struct{})}
+}
+
+// Enqueue takes a place in the queue of key, behind the work queued so far.
+// It doesn't block: call Wait on the ticket before doing the work, and Done once it is done.
+func (q *Queue) Enqueue(key string) *Ticket {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	t := &Ticket{q: q, key: key, prev: q.tails[key], done: make(chan struct{})}
+	q.tails[key] = t.done
+	return t
+}
+
+// Wait blocks until the work queued before the ticket is done.
+func (t *Ticket) Wait() {
+	if t.prev != nil {
+		<-t.prev
+	}
+}
+
+// Done lets the work queued behind the ticket run.
+// It must be called exactly once.
+func (t *Ticket) Done() {
+	t.q.mu.Lock()
+	defer t.q.mu.Unlock()
+
+	if t.q.tails[t.key] == t.done {
+		delete(t.q.tails, t.key)
+	}
+	close(t.done)
+}
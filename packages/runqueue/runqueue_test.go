@@ -0,0 +1,103 @@
+package runqueue
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// How long a test waits for work that is expected to run
+const testTimeout = time.Second
+
+// How long a test watches work that is expected to keep waiting
+const testSettle = 50 * time.Millisecond
+
+func TestQueueRunsInOrderPerKey(t *testing.T) {
+	q := NewQueue()
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+
+	tickets := make([]*Ticket, 5)
+	for i := range tickets {
+		tickets[i] = q.Enqueue("key")
+	}
+
+	// Start the work in reverse order, it must still run in the order it was queued
+	for i := len(tickets) - 1; i >= 0; i-- {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tickets[i].Wait()
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			tickets[i].Done()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("work ran in order %v, want the order it was queued in", order)
+		}
+	}
+}
+
+func TestQueueDoesNotBlockAcrossKeys(t *testing.T) {
+	q := NewQueue()
+
+	first := q.Enqueue("a")
+	first.Wait()
+	defer first.Done()
+
+	other := q.Enqueue("b")
+	waited := make(chan struct{})
+	go func() {
+		other.Wait()
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+		other.Done()
+	case <-time.After(testTimeout):
+		t.Fatal("work queued under another key waited for key a")
+	}
+}
+
+func TestDoneReleasesNextWaiter(t *testing.T) {
+	q := NewQueue()
+
+	first := q.Enqueue("key")
+	first.Wait()
+
+	second := q.Enqueue("key")
+	waited := make(chan struct{})
+	go func() {
+		second.Wait()
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+		t.Fatal("work ran before the work queued ahead of it was done")
+	case <-time.After(testSettle):
+	}
+
+	first.Done()
+	select {
+	case <-waited:
+	case <-time.After(testTimeout):
+		t.Fatal("work didn't run once the work queued ahead of it was done")
+	}
+	second.Done()
+
+	// Once the queue of the key is drained, new work runs right away
+	third := q.Enqueue("key")
+	if third.prev != nil {
+		t.Fatal("work queued under a drained key waits for finished work")
+	}
+	third.Done()
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+
+	"github.com/cloudputation/iterator/packages/command"
+	"github.com/cloudputation/iterator/packages/config"
+	"github.com/cloudputation/iterator/packages/lifecycle"
+	log "github.com/cloudputation/iterator/packages/logger"
+	"github.com/cloudputation/iterator/packages/terraform"
+)
+
+// How long a failed run of an aggregate command waits before it is retried when no window is configured
+const defaultAggregateRetry = 30 * time.Second
+
+// aggregateFiring adds a firing alert to the instances of an aggregate command,
+// and schedules a run of the command.
+func (s *Server) aggregateFiring(cmd *command.Command, alert *template.Alert, fingerprint string) error {
+	if cmd.Source == "" {
+		return fmt.Errorf("Aggregate command %s requires a static module source", cmd)
+	}
+
+	instance := alertInstance(alert, fingerprint)
+
+	return s.updateAggregate(cmd, func(aggregate *lifecycle.Aggregate) bool {
+		if _, ok := aggregate.Instances[fingerprint]; ok {
+			return false
+		}
+		log.Info("Adding instance %s to aggregate task %s", fingerprint, cmd.Task)
+		aggregate.Instances[fingerprint] = instance
+		return true
+	})
+}
+
+// alertInstance returns the instance recorded for a firing alert.
+func alertInstance(alert *template.Alert, fingerprint string) lifecycle.Instance {
+	instance := lifecycle.Instance{
+		Fingerprint: fingerprint,
+		Labels:      make(map[string]string, len(alert.Labels)),
+		Annotations: make(map[string]string, len(alert.Annotations)),
+	}
+	for k, v := range alert.Labels {
+		instance.Labels[k] = v
+	}
+	for k, v := range alert.Annotations {
+		instance.Annotations[k] = v
+	}
+	if !alert.StartsAt.IsZero() {
+		instance.StartsAt = alert.StartsAt.UTC().Format(time.RFC3339)
+	}
+	return instance
+}
+
+// aggregateResolved removes a resolved alert from the instances of an aggregate command,
+// and schedules a run of the command.
+func (s *Server) aggregateResolved(cmd *command.Command, fingerprint string) {
+	err := s.updateAggregate(cmd, func(aggregate *lifecycle.Aggregate) bool {
+		if _, ok := aggregate.Instances[fingerprint]; !ok {
+			return false
+		}
+		log.Info("Removing instance %s from aggregate task %s", fingerprint, cmd.Task)
+		delete(aggregate.Instances, fingerprint)
+		return true
+	})
+	if err != nil {
+		log.Error("Failed to remove instance %s from aggregate task %s: %v", fingerprint, cmd.Task, err)
+	}
+}
+
+// updateAggregate applies a change to the record of an aggregate command.
+// When the change modified the set of instances, the record is saved and a run is scheduled.
+func (s *Server) updateAggregate(cmd *command.Command, change func(*lifecycle.Aggregate) bool) error {
+	s.aggregateMutex.Lock()
+	defer s.aggregateMutex.Unlock()
+
+	aggregate, err := lifecycle.ReadAggregate(cmd.Task)
+	if err != nil {
+		aggregate = &lifecycle.Aggregate{
+			Task:      cmd.Task,
+			Instances: make(map[string]lifecycle.Instance),
+		}
+	}
+
+	if !change(aggregate) {
+		return nil
+	}
+	aggregate.Generation++
+
+	err = lifecycle.WriteAggregate(aggregate)
+	if err != nil {
+		return fmt.Errorf("Failed to save aggregate task %s: %w", cmd.Task, err)
+	}
+
+	s.scheduleAggregate(cmd, cmd.Durations.AggregateWindow)
+	return nil
+}
+
+// scheduleAggregate runs an aggregate command after the given delay, its coalescing window or a retry.
+// Changes happening in the meantime are applied by the same run.
+// It must be called with the aggregate mutex held.
+func (s *Server) scheduleAggregate(cmd *command.Command, delay time.Duration) {
+	if _, ok := s.aggregateTimers[cmd.Task]; ok {
+		return
+	}
+
+	log.Info("Running aggregate task %s in %s", cmd.Task, delay)
+	s.aggregateTimers[cmd.Task] = time.AfterFunc(delay, func() {
+		s.aggregateMutex.Lock()
+		delete(s.aggregateTimers, cmd.Task)
+		s.aggregateMutex.Unlock()
+
+		s.runAggregate(cmd)
+	})
+}
+
+// runAggregate applies the current instances of an aggregate command,
+// or destroys its resources once no instance is left.
+func (s *Server) runAggregate(cmd *command.Command) {
+	runLock := s.taskRunLock(cmd.Task)
+	runLock.Lock()
+	defer runLock.Unlock()
+
+	s.aggregateMutex.Lock()
+	aggregate, err := lifecycle.ReadAggregate(cmd.Task)
+	s.aggregateMutex.Unlock()
+	if err != nil {
+		log.Error("Failed to read aggregate task %s: %v", cmd.Task, err)
+		return
+	}
+
+	if !aggregate.Pending() {
+		return
+	}
+
+	start := time.Now()
+	s.processCurrent.Inc()
+	if len(aggregate.Instances) == 0 {
+		err = s.destroyAggregate(cmd, aggregate)
+	} else {
+		err = s.applyAggregate(cmd, aggregate)
+	}
+	s.processCurrent.Dec()
+	s.processDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		s.errCounter.WithLabelValues(ErrLabelStart).Inc()
+		retry := cmd.Durations.AggregateWindow
+		if retry == 0 {
+			retry = defaultAggregateRetry
+		}
+		log.Error("Failed to run aggregate task %s, retrying in %s: %v", cmd.Task, retry, err)
+
+		s.aggregateMutex.Lock()
+		s.scheduleAggregate(cmd, retry)
+		s.aggregateMutex.Unlock()
+	}
+}
+
+// applyAggregate applies an aggregate command with the list of its instances.
+func (s *Server) applyAggregate(cmd *command.Command, aggregate *lifecycle.Aggregate) error {
+	instances, err := json.Marshal(aggregate.InstanceList())
+	if err != nil {
+		return err
+	}
+
+	opts, err := taskOptions(cmd, aggregateVariable(cmd), instances, "aggregate")
+	if err != nil {
+		return err
+	}
+
+	log.Info("Applying aggregate task %s for %d instances", cmd.Task, len(aggregate.Instances))
+	modulePath, err := s.applyTask(cmd, opts)
+	if err != nil {
+		// A failed apply may have created part of the resources, they are destroyed with the aggregate
+		if modulePath != "" {
+			if recordErr := s.recordAggregateApply(cmd, modulePath, opts); recordErr != nil {
+				log.Error("Failed to save aggregate task %s: %v", cmd.Task, recordErr)
+			}
+		}
+		return err
+	}
+
+	return s.completeAggregate(cmd, aggregate.Generation, func(current *lifecycle.Aggregate) error {
+		setAggregateApply(current, cmd, modulePath, opts)
+		return lifecycle.WriteAggregate(current)
+	})
+}
+
+// recordAggregateApply records that an apply of an aggregate command ran, without completing its generation.
+func (s *Server) recordAggregateApply(cmd *command.Command, modulePath string, opts terraform.Options) error {
+	s.aggregateMutex.Lock()
+	defer s.aggregateMutex.Unlock()
+
+	current, err := lifecycle.ReadAggregate(cmd.Task)
+	if err != nil {
+		return err
+	}
+	setAggregateApply(current, cmd, modulePath, opts)
+
+	return lifecycle.WriteAggregate(current)
+}
+
+func setAggregateApply(aggregate *lifecycle.Aggregate, cmd *command.Command, modulePath string, opts terraform.Options) {
+	aggregate.Module = modulePath
+	aggregate.TerraformDriver = cmd.Cmd
+	aggregate.Options = opts
+	aggregate.Applied = true
+}
+
+// destroyAggregate destroys the resources of an aggregate command whose instances all resolved.
+func (s *Server) destroyAggregate(cmd *command.Command, aggregate *lifecycle.Aggregate) error {
+	if aggregate.Applied {
+		log.Info("No instance of aggregate task %s is firing, destroying its resources", cmd.Task)
+		err := terraform.DestroyModule(aggregate.TerraformDriver, aggregate.Module, aggregate.Options)
+		if err != nil {
+			if errors.Is(err, terraform.ErrIntegrity) {
+				s.integrityCounter.WithLabelValues(cmd.Task, "destroy").Inc()
+			}
+			return err
+		}
+	}
+
+	return s.completeAggregate(cmd, aggregate.Generation, func(current *lifecycle.Aggregate) error {
+		if len(current.Instances) == 0 {
+			return lifecycle.DeleteAggregate(cmd.Task)
+		}
+		current.Applied = false
+		return lifecycle.WriteAggregate(current)
+	})
+}
+
+// completeAggregate records a successful run of the given generation of an aggregate command.
+// Instances may have changed during the run, in which case another run is already scheduled.
+func (s *Server) completeAggregate(cmd *command.Command, generation int, save func(*lifecycle.Aggregate) error) error {
+	s.aggregateMutex.Lock()
+	defer s.aggregateMutex.Unlock()
+
+	current, err := lifecycle.ReadAggregate(cmd.Task)
+	if err != nil {
+		return err
+	}
+	current.AppliedGeneration = generation
+
+	return save(current)
+}
+
+// recoverAggregates schedules the aggregate commands whose instances changed since their last successful run,
+// for instance when Iterator stopped within a coalescing window.
+func (s *Server) recoverAggregates() {
+	aggregates, err := lifecycle.ListAggregates()
+	if err != nil {
+		log.Error("Failed to list aggregate tasks: %v", err)
+		return
+	}
+
+	s.aggregateMutex.Lock()
+	defer s.aggregateMutex.Unlock()
+
+	for _, aggregate := range aggregates {
+		if !aggregate.Pending() {
+			continue
+		}
+		for _, cmd := range s.config.Commands {
+			if cmd.IsAggregate() && cmd.Task == aggregate.Task {
+				s.scheduleAggregate(cmd, cmd.Durations.AggregateWindow)
+			}
+		}
+	}
+}
+
+func aggregateVariable(cmd *command.Command) string {
+	if cmd.AggregateVariable == "" {
+		return config.DefaultAggregateVariable
+	}
+	return cmd.AggregateVariable
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+
+	"github.com/cloudputation/iterator/packages/command"
+	"github.com/cloudputation/iterator/packages/lifecycle"
+	log "github.com/cloudputation/iterator/packages/logger"
+)
+
+// cooldownKey returns the key of the cooldown holding back the alert with the given fingerprint for a command.
+func cooldownKey(cmd *command.Command, fingerprint string) string {
+	if cmd.CooldownScope != command.CooldownScopeFingerprint {
+		fingerprint = ""
+	}
+	return lifecycle.CooldownKey(cmd.Task, fingerprint)
+}
+
+// startCooldown holds back the firing alerts of a task once it ran a Terraform operation for the given fingerprint.
+func (s *Server) startCooldown(taskName, fingerprint, operation string) {
+	cmd := s.taskCommand(taskName)
+	if cmd == nil {
+		return
+	}
+
+	duration := cmd.Durations.CooldownAfterApply
+	if operation == "destroy" {
+		duration = cmd.Durations.CooldownAfterDestroy
+	}
+	if duration == 0 {
+		return
+	}
+
+	key := cooldownKey(cmd, fingerprint)
+	cooldown := &lifecycle.Cooldown{
+		Task:      taskName,
+		Operation: operation,
+		Until:     time.Now().Add(duration).UTC(),
+	}
+	if cmd.CooldownScope == command.CooldownScopeFingerprint {
+		cooldown.Fingerprint = fingerprint
+	}
+
+	err := lifecycle.WriteCooldown(key, cooldown)
+	if err != nil {
+		log.Error("Failed to start cooldown %s of task %s: %v", key, taskName, err)
+		return
+	}
+
+	log.Info("Task %s ran %s, cooling down %s for %s", taskName, operation, key, duration)
+}
+
+// coolingDown returns true if a cooldown of the command holds back the alert.
+// Cooldowns that are over are dropped.
+func (s *Server) coolingDown(cmd *command.Command, alert *template.Alert) bool {
+	if cmd.CooldownAfterApply == "" && cmd.CooldownAfterDestroy == "" {
+		return false
+	}
+
+	fingerprint, _ := cmd.Fingerprint(alert)
+	key := cooldownKey(cmd, fingerprint)
+	cooldown, err := lifecycle.ReadCooldown(key)
+	if err != nil {
+		return false
+	}
+
+	if time.Now().Before(cooldown.Until) {
+		log.Debug("Task %s is cooling down after %s until %s", cmd.Task, cooldown.Operation, cooldown.Until.Format(time.RFC3339))
+		return true
+	}
+
+	err = lifecycle.DeleteCooldown(key)
+	if err != nil {
+		log.Error("Failed to drop cooldown %s: %v", key, err)
+	}
+	return false
+}
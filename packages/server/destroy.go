@@ -0,0 +1,200 @@
+package server
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/cloudputation/iterator/packages/command"
+	"github.com/cloudputation/iterator/packages/lifecycle"
+	log "github.com/cloudputation/iterator/packages/logger"
+)
+
+// verifyDestroy checks the module of an alert record before its resources are destroyed,
+// and records the integrity violation on the alert record when the module was tampered with.
+func (s *Server) verifyDestroy(alertKey string, alertRecord *lifecycle.Alert) bool {
+	err := lifecycle.VerifyAlert(alertRecord)
+	if err == nil {
+		return true
+	}
+
+	log.Error("Refusing to destroy module %s for alert %s: %v", alertRecord.Module, alertRecord.AlertName, err)
+	s.integrityCounter.WithLabelValues(alertRecord.Task, "destroy").Inc()
+	alertRecord.IntegrityError = err.Error()
+	err = lifecycle.WriteAlert(alertKey, alertRecord)
+	if err != nil {
+		log.Error("Failed to record integrity violation for alert %s: %v", alertRecord.AlertName, err)
+	}
+
+	return false
+}
+
+// deferDestroy schedules the destroy of the resources of a resolved alert once the resolve delay elapsed.
+// The alert record is kept until then, so that the alert firing again keeps its resources.
+func (s *Server) deferDestroy(alertKey string, alertRecord *lifecycle.Alert, delay time.Duration) {
+	s.destroyMutex.Lock()
+	if alertRecord.DestroyAt == nil {
+		destroyAt := time.Now().Add(delay).UTC()
+		alertRecord.DestroyAt = &destroyAt
+	}
+	err := lifecycle.WriteAlert(alertKey, alertRecord)
+	s.destroyMutex.Unlock()
+	if err != nil {
+		log.Error("Failed to schedule destroy of alert %s: %v", alertKey, err)
+		return
+	}
+
+	log.Info("Destroying resources of alert %s in %s unless it fires again", alertKey, time.Until(*alertRecord.DestroyAt).Round(time.Second))
+	s.scheduleDestroy(alertKey, *alertRecord.DestroyAt)
+}
+
+// scheduleDestroy runs the pending destroy of the alert record stored under key at the given time.
+func (s *Server) scheduleDestroy(key string, destroyAt time.Time) {
+	s.destroyMutex.Lock()
+	defer s.destroyMutex.Unlock()
+
+	if timer, ok := s.destroyTimers[key]; ok {
+		timer.Stop()
+	}
+
+	s.destroyTimers[key] = time.AfterFunc(time.Until(destroyAt), func() {
+		s.runDestroy(key)
+	})
+}
+
+// cancelDestroy cancels the pending destroy of the alert record stored under key, as its alert fired again.
+func (s *Server) cancelDestroy(key string) {
+	s.destroyMutex.Lock()
+	defer s.destroyMutex.Unlock()
+
+	if timer, ok := s.destroyTimers[key]; ok {
+		timer.Stop()
+		delete(s.destroyTimers, key)
+	}
+
+	alertRecord, err := lifecycle.ReadAlert(key)
+	if err != nil || alertRecord.DestroyAt == nil {
+		return
+	}
+
+	alertRecord.DestroyAt = nil
+	err = lifecycle.WriteAlert(key, alertRecord)
+	if err != nil {
+		log.Error("Failed to cancel pending destroy of alert %s: %v", key, err)
+		return
+	}
+	log.Info("Alert %s fired again, cancelled the pending destroy of its resources", key)
+}
+
+// handOverDestroys cancels the pending destroys of the task's resolved alerts whose resources
+// the firing alert applies again: those sharing its module directory and workspace.
+// The records of the resolved alerts are dropped, their resources now belong to the firing alert.
+func (s *Server) handOverDestroys(cmd *command.Command, fingerprint, source, workspace string) {
+	modulePath, err := filepath.Abs(source)
+	if err != nil {
+		return
+	}
+
+	alerts, err := lifecycle.ListAlerts()
+	if err != nil {
+		log.Error("Failed to list pending destroys: %v", err)
+		return
+	}
+
+	s.destroyMutex.Lock()
+	defer s.destroyMutex.Unlock()
+
+	for key, alertRecord := range alerts {
+		if alertRecord.DestroyAt == nil || alertRecord.Task != cmd.Task || alertRecord.Fingerprint == fingerprint {
+			continue
+		}
+		if len(alertRecord.Elements) > 0 || alertRecord.Module != modulePath || alertRecord.Workspace != workspace {
+			continue
+		}
+
+		if timer, ok := s.destroyTimers[key]; ok {
+			timer.Stop()
+			delete(s.destroyTimers, key)
+		}
+		err := lifecycle.DeleteAlert(key)
+		if err != nil {
+			log.Error("Failed to hand over resources of alert %s: %v", key, err)
+			continue
+		}
+		lifecycle.DiscardAlert(alertRecord)
+		log.Info("Task %s fired again for alert %s, keeping the resources of resolved alert %s", cmd.Task, fingerprint, key)
+		setState(alertRecord.Task, alertRecord.AlertName, alertRecord.Fingerprint, lifecycle.StateReleased, "resources handed over to alert "+fingerprint)
+	}
+}
+
+// runDestroy destroys the resources of a resolved alert whose resolve delay elapsed without it firing again.
+func (s *Server) runDestroy(key string) {
+	s.destroyMutex.Lock()
+	delete(s.destroyTimers, key)
+	alertRecord, err := lifecycle.ReadAlert(key)
+	s.destroyMutex.Unlock()
+	if err != nil || alertRecord.DestroyAt == nil {
+		log.Debug("Alert %s is no longer pending destroy", key)
+		return
+	}
+
+	// The destroy is queued behind the run under way for the alert, which may cancel it
+	ticket := s.runQueue.Enqueue(lifecycle.LifecycleKey(alertRecord.Task, alertRecord.Fingerprint))
+	ticket.Wait()
+	defer ticket.Done()
+
+	s.destroyMutex.Lock()
+	alertRecord, err = lifecycle.ReadAlert(key)
+	if err != nil || alertRecord.DestroyAt == nil {
+		s.destroyMutex.Unlock()
+		log.Debug("Alert %s is no longer pending destroy", key)
+		return
+	}
+
+	if time.Now().Before(*alertRecord.DestroyAt) {
+		s.destroyMutex.Unlock()
+		s.scheduleDestroy(key, *alertRecord.DestroyAt)
+		return
+	}
+
+	if !s.verifyDestroy(key, alertRecord) {
+		s.destroyMutex.Unlock()
+		return
+	}
+
+	// The record is dropped before the destroy runs, so that the alert firing again from now on is a new one
+	err = lifecycle.DeleteAlert(key)
+	s.destroyMutex.Unlock()
+	if err != nil {
+		log.Error("Failed to delete fingerprint data: %v", err)
+		return
+	}
+
+	log.Info("Resolve delay of alert %s elapsed, destroying its resources", key)
+	setState(alertRecord.Task, alertRecord.AlertName, alertRecord.Fingerprint, lifecycle.StateDestroying, "resolve delay elapsed")
+	err = lifecycle.DestroyAlert(alertRecord.TerraformDriver, alertRecord)
+	if err != nil {
+		log.Error("Failed to destroy module %s for alert %s: %v", alertRecord.Module, alertRecord.AlertName, err)
+		setState(alertRecord.Task, alertRecord.AlertName, alertRecord.Fingerprint, lifecycle.StateFailed, err.Error())
+	} else {
+		setState(alertRecord.Task, alertRecord.AlertName, alertRecord.Fingerprint, lifecycle.StateDestroyed, "module destroyed")
+		s.startCooldown(alertRecord.Task, alertRecord.Fingerprint, "destroy")
+	}
+
+	s.tellFingers.Close(alertRecord.Fingerprint)
+}
+
+// recoverDestroys schedules the pending destroys persisted with the alert records,
+// so that alerts whose resolve delay elapsed while Iterator was stopped are destroyed at startup.
+func (s *Server) recoverDestroys() {
+	alerts, err := lifecycle.ListAlerts()
+	if err != nil {
+		log.Error("Failed to list pending destroys: %v", err)
+		return
+	}
+
+	for key, alertRecord := range alerts {
+		if alertRecord.DestroyAt != nil {
+			s.scheduleDestroy(key, *alertRecord.DestroyAt)
+		}
+	}
+}
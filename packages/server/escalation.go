@@ -0,0 +1,230 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+
+	"github.com/cloudputation/iterator/packages/command"
+	"github.com/cloudputation/iterator/packages/lifecycle"
+	log "github.com/cloudputation/iterator/packages/logger"
+	"github.com/cloudputation/iterator/packages/terraform"
+)
+
+// escalationFiring records a firing alert under the severity of its target,
+// and re-applies the target when the alert raised its highest firing severity.
+func (s *Server) escalationFiring(cmd *command.Command, alert *template.Alert, fingerprint string) error {
+	severity := alert.Labels[cmd.Escalation.SeverityLabel]
+	if cmd.Escalation.Step(severity) < 0 {
+		log.Info("Alert %s has no escalation step for severity %q of task %s. Skipping..", alert.Labels["alertname"], severity, cmd.Task)
+		return nil
+	}
+
+	return s.updateEscalation(cmd, alert, func(escalation *lifecycle.Escalation) {
+		escalation.Severities[severity] = alertInstance(alert, fingerprint)
+	})
+}
+
+// escalationResolved removes a resolved alert from the severities of its target,
+// and steps the target back down to its highest severity still firing.
+func (s *Server) escalationResolved(cmd *command.Command, alert *template.Alert, fingerprint string) {
+	severity := alert.Labels[cmd.Escalation.SeverityLabel]
+	if cmd.Escalation.Step(severity) < 0 {
+		return
+	}
+
+	err := s.updateEscalation(cmd, alert, func(escalation *lifecycle.Escalation) {
+		if instance, ok := escalation.Severities[severity]; ok && instance.Fingerprint == fingerprint {
+			delete(escalation.Severities, severity)
+		}
+	})
+	if err != nil {
+		log.Error("Failed to step down escalation of task %s for alert %s: %v", cmd.Task, alert.Labels["alertname"], err)
+	}
+}
+
+// updateEscalation applies a change to the severities of the target of an alert,
+// then applies the target with the inputs of its highest firing severity,
+// or destroys its resources once no severity is firing.
+func (s *Server) updateEscalation(cmd *command.Command, alert *template.Alert, change func(*lifecycle.Escalation)) error {
+	target, labels := escalationTarget(cmd, alert)
+	key := lifecycle.EscalationKey(cmd.Task, target)
+
+	runLock := s.taskRunLock(key)
+	runLock.Lock()
+	defer runLock.Unlock()
+
+	escalation, err := lifecycle.ReadEscalation(key)
+	if err != nil {
+		escalation = &lifecycle.Escalation{
+			Task:       cmd.Task,
+			Target:     target,
+			Labels:     labels,
+			Severities: make(map[string]lifecycle.Instance),
+		}
+	}
+	change(escalation)
+
+	step := -1
+	for severity := range escalation.Severities {
+		if i := cmd.Escalation.Step(severity); i > step {
+			step = i
+		}
+	}
+
+	if step < 0 {
+		return s.clearEscalation(cmd, key, escalation)
+	}
+
+	severity := cmd.Escalation.Steps[step].Severity
+	if severity == escalation.Step {
+		return lifecycle.WriteEscalation(key, escalation)
+	}
+
+	err = s.applyEscalation(cmd, escalation, step)
+	if err != nil {
+		// The severities are still recorded, the step is retried on the next notification of the target
+		if writeErr := lifecycle.WriteEscalation(key, escalation); writeErr != nil {
+			log.Error("Failed to save escalation of task %s for target %s: %v", cmd.Task, target, writeErr)
+		}
+		return err
+	}
+
+	return lifecycle.WriteEscalation(key, escalation)
+}
+
+// applyEscalation applies the target of an escalation with the inputs of a step,
+// rendered against the alert firing for the step's severity.
+func (s *Server) applyEscalation(cmd *command.Command, escalation *lifecycle.Escalation, step int) error {
+	severity := cmd.Escalation.Steps[step].Severity
+	instance := escalation.Severities[severity]
+
+	variables := make(map[string]string, len(cmd.Variables)+len(cmd.Escalation.Steps[step].Variables))
+	for name, src := range cmd.Variables {
+		variables[name] = src
+	}
+	for name, src := range cmd.Escalation.Steps[step].Variables {
+		variables[name] = src
+	}
+
+	// The runs of every severity share the state of the target: the alert exposed to the
+	// expressions carries the target as its fingerprint, so a per_fingerprint workspace is the target's.
+	alert := instanceAlert(instance)
+	alert.Fingerprint = escalation.Target
+
+	opts, err := terraform.NewOptions(terraform.Expressions{
+		Targets:       cmd.Targets,
+		Replace:       cmd.Replace,
+		RefreshOnly:   cmd.RefreshOnly,
+		BackendConfig: cmd.BackendConfig,
+		Variables:     variables,
+		Workspace:     cmd.Workspace,
+	}, alert)
+	if err != nil {
+		return fmt.Errorf("Failed to render Terraform options of task %s for step %s: %w", cmd.Task, severity, err)
+	}
+
+	opts.Checksum = cmd.SourceChecksum
+	if len(opts.Variables) > 0 {
+		opts.VarFile, err = terraform.VarFilePath(cmd.Task, "escalation-"+escalation.Target)
+		if err != nil {
+			return err
+		}
+	}
+	err = opts.IsolateBackend(cmd.Task, "escalation-"+escalation.Target)
+	if err != nil {
+		return err
+	}
+
+	direction := "Escalating"
+	if escalation.Step != "" && cmd.Escalation.Step(escalation.Step) > step {
+		direction = "Stepping down"
+	}
+	log.Info("%s target %s of task %s to step %s", direction, escalation.Target, cmd.Task, severity)
+
+	start := time.Now()
+	s.processCurrent.Inc()
+	modulePath, err := s.applyTask(cmd, opts)
+	s.processCurrent.Dec()
+	s.processDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return fmt.Errorf("Failed to apply step %s of task %s for target %s: %w", severity, cmd.Task, escalation.Target, err)
+	}
+
+	escalation.Step = severity
+	escalation.Module = modulePath
+	escalation.TerraformDriver = cmd.Cmd
+	escalation.Options = opts
+
+	return nil
+}
+
+// clearEscalation destroys the resources of a target none of whose severities is firing anymore.
+func (s *Server) clearEscalation(cmd *command.Command, key string, escalation *lifecycle.Escalation) error {
+	if escalation.Step != "" {
+		log.Info("No severity of target %s of task %s is firing, destroying its resources", escalation.Target, cmd.Task)
+		err := terraform.DestroyModule(escalation.TerraformDriver, escalation.Module, escalation.Options)
+		if err != nil {
+			if errors.Is(err, terraform.ErrIntegrity) {
+				s.integrityCounter.WithLabelValues(cmd.Task, "destroy").Inc()
+			}
+			if writeErr := lifecycle.WriteEscalation(key, escalation); writeErr != nil {
+				log.Error("Failed to save escalation of task %s for target %s: %v", cmd.Task, escalation.Target, writeErr)
+			}
+			return err
+		}
+	}
+
+	return lifecycle.DeleteEscalation(key)
+}
+
+// escalationTarget identifies the target of an alert: the alerts sharing its target labels,
+// or all its labels but the severity when the ladder doesn't list target labels.
+func escalationTarget(cmd *command.Command, alert *template.Alert) (string, map[string]string) {
+	labels := make(map[string]string)
+	if len(cmd.Escalation.TargetLabels) > 0 {
+		for _, name := range cmd.Escalation.TargetLabels {
+			labels[name] = alert.Labels[name]
+		}
+	} else {
+		for name, value := range alert.Labels {
+			if name != cmd.Escalation.SeverityLabel {
+				labels[name] = value
+			}
+		}
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%s\n", name, labels[name])
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+
+	return hex.EncodeToString(sum[:8]), labels
+}
+
+// instanceAlert returns the firing alert an instance was recorded for.
+func instanceAlert(instance lifecycle.Instance) *template.Alert {
+	alert := &template.Alert{
+		Status:      "firing",
+		Labels:      instance.Labels,
+		Annotations: instance.Annotations,
+		Fingerprint: instance.Fingerprint,
+	}
+	if startsAt, err := time.Parse(time.RFC3339, instance.StartsAt); err == nil {
+		alert.StartsAt = startsAt
+	}
+	return alert
+}
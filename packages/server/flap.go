@@ -0,0 +1,272 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+
+	"github.com/cloudputation/iterator/packages/command"
+	"github.com/cloudputation/iterator/packages/lifecycle"
+	log "github.com/cloudputation/iterator/packages/logger"
+)
+
+// FlappingAlert is an alert whose runs are suspended because it flaps.
+type FlappingAlert struct {
+	Key         string    `json:"key"`
+	AlertName   string    `json:"alert_name"`
+	Fingerprint string    `json:"fingerprint"`
+	Task        string    `json:"task"`
+	Transitions int       `json:"transitions"`
+	SuspendedAt time.Time `json:"suspended_at"`
+}
+
+// trackFlap records a notification of an alert for a command detecting flapping.
+// It returns true while the runs of the command are suspended for the alert.
+func (s *Server) trackFlap(cmd *command.Command, alert *template.Alert, fingerprint string) bool {
+	if cmd.FlapDetection == nil {
+		return false
+	}
+
+	window := cmd.Durations.FlapWindow
+	key := lifecycle.FlapKey(cmd.Task, fingerprint)
+
+	s.flapMutex.Lock()
+	defer s.flapMutex.Unlock()
+
+	flap, err := lifecycle.ReadFlap(key)
+	if err != nil {
+		flap = &lifecycle.Flap{Task: cmd.Task, AlertName: alert.Labels["alertname"], Fingerprint: fingerprint}
+	}
+
+	now := time.Now().UTC()
+	if !flap.Record(alert.Status, now) {
+		return flap.SuspendedAt != nil
+	}
+
+	transitions := flap.Prune(now, window)
+	if flap.SuspendedAt == nil && transitions >= cmd.FlapDetection.Threshold {
+		flap.SuspendedAt = &now
+		log.Warn("Alert %s flapped %d times within %s, suspending the runs of task %s for it until acknowledged or the flapping subsides",
+			flap.AlertName, transitions, window, cmd.Task)
+		s.flapGauge.WithLabelValues(cmd.Task, fingerprint).Set(1)
+	}
+
+	err = lifecycle.WriteFlap(key, flap)
+	if err != nil {
+		log.Error("Failed to record transition of alert %s: %v", key, err)
+	}
+
+	if flap.SuspendedAt == nil {
+		return false
+	}
+	s.scheduleFlap(key, flap.SubsidesAt(window, cmd.FlapDetection.Threshold))
+	return true
+}
+
+// scheduleFlap checks whether the flapping of the alert stored under key subsided at the given time.
+// It must be called with the flap mutex held.
+func (s *Server) scheduleFlap(key string, subsidesAt time.Time) {
+	if timer, ok := s.flapTimers[key]; ok {
+		timer.Stop()
+	}
+
+	s.flapTimers[key] = time.AfterFunc(time.Until(subsidesAt), func() {
+		s.runFlap(key)
+	})
+}
+
+// runFlap lifts the suspension of an alert once fewer transitions than the threshold remain within the window.
+func (s *Server) runFlap(key string) {
+	s.flapMutex.Lock()
+	defer s.flapMutex.Unlock()
+
+	delete(s.flapTimers, key)
+	flap, err := lifecycle.ReadFlap(key)
+	if err != nil || flap.SuspendedAt == nil {
+		log.Debug("Alert %s is no longer suspended", key)
+		return
+	}
+
+	// Tasks that no longer detect flapping don't keep their alerts suspended
+	if cmd := s.taskCommand(flap.Task); cmd != nil && cmd.FlapDetection != nil {
+		window := cmd.Durations.FlapWindow
+		flap.Prune(time.Now(), window)
+		if subsidesAt := flap.SubsidesAt(window, cmd.FlapDetection.Threshold); time.Now().Before(subsidesAt) {
+			s.scheduleFlap(key, subsidesAt)
+			return
+		}
+	}
+
+	log.Info("Alert %s stopped flapping, resuming the runs of task %s for it", flap.AlertName, flap.Task)
+	s.liftFlap(key, flap)
+}
+
+// ackFlap lifts the suspension of a flapping alert on behalf of an operator.
+// Its transitions are forgotten, so that it isn't suspended again right away.
+func (s *Server) ackFlap(key string) error {
+	s.flapMutex.Lock()
+	defer s.flapMutex.Unlock()
+
+	flap, err := lifecycle.ReadFlap(key)
+	if err != nil {
+		return err
+	}
+	if flap.SuspendedAt == nil {
+		return fmt.Errorf("alert %s is not suspended", key)
+	}
+
+	if timer, ok := s.flapTimers[key]; ok {
+		timer.Stop()
+		delete(s.flapTimers, key)
+	}
+
+	log.Info("Flapping of alert %s acknowledged, resuming the runs of task %s for it", flap.AlertName, flap.Task)
+	flap.Transitions = nil
+	return s.liftFlap(key, flap)
+}
+
+// liftFlap resumes the runs of a suspended alert.
+// An alert whose last notification resolved it is resolved right away, as its resolution was skipped.
+// It must be called with the flap mutex held.
+func (s *Server) liftFlap(key string, flap *lifecycle.Flap) error {
+	flap.SuspendedAt = nil
+	s.flapGauge.DeleteLabelValues(flap.Task, flap.Fingerprint)
+
+	err := lifecycle.WriteFlap(key, flap)
+	if err != nil {
+		log.Error("Failed to lift suspension of alert %s: %v", key, err)
+		return err
+	}
+
+	if flap.Status != "resolved" {
+		return nil
+	}
+	cmd := s.taskCommand(flap.Task)
+	if cmd == nil {
+		return nil
+	}
+	if _, err := lifecycle.ReadAlert(lifecycle.AlertKey(flap.AlertName, flap.Fingerprint)); err != nil {
+		return nil
+	}
+
+	log.Info("Alert %s resolved while it was suspended, resolving it for task %s", flap.AlertName, flap.Task)
+	s.queueResolve(cmd, template.Alert{
+		Status:      "resolved",
+		Labels:      template.KV{"alertname": flap.AlertName},
+		Fingerprint: flap.Fingerprint,
+	}, flap.Fingerprint)
+	return nil
+}
+
+// taskCommand returns the command of a task, or nil if there is none.
+func (s *Server) taskCommand(taskName string) *command.Command {
+	for _, cmd := range s.config.Commands {
+		if cmd.Task == taskName {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// flappingAlerts returns the alerts whose runs are suspended, the oldest suspension first.
+func flappingAlerts() ([]FlappingAlert, error) {
+	flaps, err := lifecycle.ListFlaps()
+	if err != nil {
+		return nil, err
+	}
+
+	flapping := []FlappingAlert{}
+	for key, flap := range flaps {
+		if flap.SuspendedAt == nil {
+			continue
+		}
+		flapping = append(flapping, FlappingAlert{
+			Key:         key,
+			AlertName:   flap.AlertName,
+			Fingerprint: flap.Fingerprint,
+			Task:        flap.Task,
+			Transitions: len(flap.Transitions),
+			SuspendedAt: *flap.SuspendedAt,
+		})
+	}
+	sort.Slice(flapping, func(i, j int) bool { return flapping[i].SuspendedAt.Before(flapping[j].SuspendedAt) })
+
+	return flapping, nil
+}
+
+// recoverFlaps restores the suspensions persisted before Iterator stopped,
+// lifting those whose flapping subsided in the meantime.
+func (s *Server) recoverFlaps() {
+	flapping, err := flappingAlerts()
+	if err != nil {
+		log.Error("Failed to list flapping alerts: %v", err)
+		return
+	}
+
+	s.flapMutex.Lock()
+	defer s.flapMutex.Unlock()
+
+	for _, flap := range flapping {
+		s.flapGauge.WithLabelValues(flap.Task, flap.Fingerprint).Set(1)
+		s.scheduleFlap(flap.Key, time.Now())
+	}
+}
+
+// handleFlaps responds with the alerts whose runs are suspended because they flap.
+func (s *Server) handleFlaps(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flapping, err := flappingAlerts()
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(flapping)
+	if err != nil {
+		handleError(w, err)
+	}
+}
+
+// handleFlapAck lifts the suspension of a flapping alert, as acknowledged by an operator.
+func (s *Server) handleFlapAck(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+
+	var ack struct {
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(data, &ack); err != nil {
+		handleError(w, err)
+		return
+	}
+
+	if ack.Key == "" {
+		handleError(w, fmt.Errorf("flap key is required"))
+		return
+	}
+
+	if err := s.ackFlap(ack.Key); err != nil {
+		handleError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+
+	"github.com/cloudputation/iterator/packages/command"
+	"github.com/cloudputation/iterator/packages/lifecycle"
+	log "github.com/cloudputation/iterator/packages/logger"
+)
+
+// leaseDeadline returns when the alert records of a command expire if no firing notification renews them.
+func leaseDeadline(cmd *command.Command) *time.Time {
+	if cmd.Lease == nil {
+		return nil
+	}
+
+	expiresAt := time.Now().Add(cmd.Durations.Lease).UTC()
+	return &expiresAt
+}
+
+// renewLease pushes back the expiry of the record of a firing alert.
+// Records that don't exist yet get their lease once the command ran for the alert.
+// The renewal takes its place in the run queue of the alert, so that it doesn't write back a record
+// resolved in the meantime, but it doesn't hold back the notification.
+func (s *Server) renewLease(cmd *command.Command, alert *template.Alert) {
+	fingerprint, ok := cmd.Fingerprint(alert)
+	if !ok || fingerprint == "" {
+		return
+	}
+
+	ticket := s.runQueue.Enqueue(lifecycle.LifecycleKey(cmd.Task, fingerprint))
+	alertKey := lifecycle.AlertKey(alert.Labels["alertname"], fingerprint)
+	go func() {
+		ticket.Wait()
+		defer ticket.Done()
+		s.extendLease(cmd, alertKey, fingerprint)
+	}()
+}
+
+// extendLease pushes back the expiry of the alert record stored under key, if it still exists.
+// It must be called with the run queue ticket of the alert.
+func (s *Server) extendLease(cmd *command.Command, alertKey, fingerprint string) {
+	alertRecord, err := lifecycle.ReadAlert(alertKey)
+	if err != nil || alertRecord.Fingerprint != fingerprint {
+		return
+	}
+
+	alertRecord.LeaseExpiresAt = leaseDeadline(cmd)
+	if alertRecord.LeaseExpiresAt == nil {
+		return
+	}
+	err = lifecycle.WriteAlert(alertKey, alertRecord)
+	if err != nil {
+		log.Error("Failed to renew lease of alert %s: %v", alertKey, err)
+		return
+	}
+
+	log.Debug("Renewed lease of alert %s until %s", alertKey, alertRecord.LeaseExpiresAt.Format(time.RFC3339))
+	s.scheduleLease(alertKey, *alertRecord.LeaseExpiresAt)
+}
+
+// scheduleLease checks the lease of the alert record stored under key once it is due to expire.
+func (s *Server) scheduleLease(key string, expiresAt time.Time) {
+	s.leaseMutex.Lock()
+	defer s.leaseMutex.Unlock()
+
+	if timer, ok := s.leaseTimers[key]; ok {
+		timer.Stop()
+	}
+
+	s.leaseTimers[key] = time.AfterFunc(time.Until(expiresAt), func() {
+		s.leaseMutex.Lock()
+		delete(s.leaseTimers, key)
+		s.leaseMutex.Unlock()
+
+		s.expireLease(key)
+	})
+}
+
+// expireLease resolves the alert of a record whose lease expired without being renewed,
+// as if Alertmanager had sent the resolved notification.
+func (s *Server) expireLease(key string) {
+	alertRecord, err := lifecycle.ReadAlert(key)
+	if err != nil || alertRecord.LeaseExpiresAt == nil {
+		log.Debug("Alert %s no longer holds a lease", key)
+		return
+	}
+
+	// The record is updated behind the run under way for the alert, which may renew or resolve it
+	ticket := s.runQueue.Enqueue(lifecycle.LifecycleKey(alertRecord.Task, alertRecord.Fingerprint))
+	ticket.Wait()
+	alertRecord, err = lifecycle.ReadAlert(key)
+	if err != nil || alertRecord.LeaseExpiresAt == nil {
+		ticket.Done()
+		log.Debug("Alert %s no longer holds a lease", key)
+		return
+	}
+
+	if time.Now().Before(*alertRecord.LeaseExpiresAt) {
+		ticket.Done()
+		s.scheduleLease(key, *alertRecord.LeaseExpiresAt)
+		return
+	}
+
+	labels := alertRecord.Labels
+	if labels == nil {
+		labels = map[string]string{"alertname": alertRecord.AlertName}
+	}
+
+	// Records the resolve path keeps, like sawtooth ones, aren't resolved again
+	expiredAt := *alertRecord.LeaseExpiresAt
+	alertRecord.LeaseExpiresAt = nil
+	err = lifecycle.WriteAlert(key, alertRecord)
+	ticket.Done()
+	if err != nil {
+		log.Error("Failed to clear expired lease of alert %s: %v", key, err)
+	}
+
+	log.Warn("Lease of alert %s expired at %s without a firing notification, resolving it", key, expiredAt.Format(time.RFC3339))
+	s.amResolved(template.Alert{
+		Status:      "resolved",
+		Labels:      labels,
+		Fingerprint: alertRecord.Fingerprint,
+		EndsAt:      expiredAt,
+	})
+}
+
+// recoverLeases schedules the leases persisted with the alert records,
+// so that alerts whose lease expired while Iterator was stopped are resolved at startup.
+func (s *Server) recoverLeases() {
+	alerts, err := lifecycle.ListAlerts()
+	if err != nil {
+		log.Error("Failed to list alert leases: %v", err)
+		return
+	}
+
+	for key, alertRecord := range alerts {
+		if alertRecord.LeaseExpiresAt != nil {
+			s.scheduleLease(key, *alertRecord.LeaseExpiresAt)
+		}
+	}
+}
+
+// copyLabels returns a copy of the labels of an alert, to be kept with its record.
+func copyLabels(labels map[string]string) map[string]string {
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
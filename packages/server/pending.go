@@ -0,0 +1,134 @@
+package server
+
+import (
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+
+	"github.com/cloudputation/iterator/packages/command"
+	"github.com/cloudputation/iterator/packages/lifecycle"
+	log "github.com/cloudputation/iterator/packages/logger"
+)
+
+// parkAlert holds a firing alert back until the fire delay of the command elapsed.
+// It returns false when the command should run right away: the alert was already applied,
+// and this is one of its repeated notifications.
+func (s *Server) parkAlert(cmd *command.Command, alert *template.Alert, fingerprint string) bool {
+	delay := cmd.Durations.FireDelay
+	if delay == 0 {
+		return false
+	}
+
+	if ranFor(cmd, alert.Labels["alertname"], fingerprint) {
+		return false
+	}
+
+	key := lifecycle.PendingKey(cmd.Task, fingerprint)
+
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+
+	if _, err := lifecycle.ReadPending(key); err == nil {
+		// Already parked, the delay runs from the first notification
+		return true
+	}
+
+	pending := &lifecycle.PendingAlert{
+		Task:        cmd.Task,
+		Fingerprint: fingerprint,
+		FireAt:      time.Now().Add(delay).UTC(),
+		Alert:       *alert,
+	}
+	err := lifecycle.WritePending(key, pending)
+	if err != nil {
+		log.Error("Failed to park alert %s for task %s, running it right away: %v", alert.Labels["alertname"], cmd.Task, err)
+		return false
+	}
+
+	log.Info("Parking alert %s for task %s, applying it in %s unless it resolves", alert.Labels["alertname"], cmd.Task, delay)
+	setState(cmd.Task, alert.Labels["alertname"], fingerprint, lifecycle.StatePending, "waiting for the fire delay")
+	s.schedulePending(key, pending.FireAt)
+	return true
+}
+
+// unparkAlert drops the pending alert of a command once it resolved within the fire delay.
+// It returns true if the alert was pending, in which case the command never ran for it.
+func (s *Server) unparkAlert(cmd *command.Command, alert *template.Alert, fingerprint string) bool {
+	key := lifecycle.PendingKey(cmd.Task, fingerprint)
+
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+
+	if timer, ok := s.pendingTimers[key]; ok {
+		timer.Stop()
+		delete(s.pendingTimers, key)
+	}
+
+	if _, err := lifecycle.ReadPending(key); err != nil {
+		return false
+	}
+
+	err := lifecycle.DeletePending(key)
+	if err != nil {
+		log.Error("Failed to drop pending alert %s: %v", key, err)
+	}
+	log.Info("Alert %s resolved within the fire delay of task %s, not applying it", alert.Labels["alertname"], cmd.Task)
+	setState(cmd.Task, alert.Labels["alertname"], fingerprint, lifecycle.StateCancelled, "resolved within the fire delay")
+	return true
+}
+
+// schedulePending runs the command of a pending alert once its fire delay elapsed.
+// It must be called with the pending mutex held.
+func (s *Server) schedulePending(key string, fireAt time.Time) {
+	if timer, ok := s.pendingTimers[key]; ok {
+		timer.Stop()
+	}
+
+	s.pendingTimers[key] = time.AfterFunc(time.Until(fireAt), func() {
+		s.firePending(key)
+	})
+}
+
+// firePending runs the command of an alert that kept firing for the whole fire delay.
+func (s *Server) firePending(key string) {
+	s.pendingMutex.Lock()
+	delete(s.pendingTimers, key)
+	pending, err := lifecycle.ReadPending(key)
+	if err == nil {
+		err = lifecycle.DeletePending(key)
+	}
+	s.pendingMutex.Unlock()
+	if err != nil {
+		log.Debug("Alert %s is no longer pending: %v", key, err)
+		return
+	}
+
+	var commands []*command.Command
+	for _, cmd := range s.config.Commands {
+		if cmd.Task == pending.Task {
+			commands = append(commands, cmd)
+		}
+	}
+
+	log.Info("Alert %s kept firing for the fire delay of task %s, applying it", pending.Alert.Labels["alertname"], pending.Task)
+	for _, err := range s.fireCommands(&pending.Alert, commands, true) {
+		log.Error("Failed to run task %s for pending alert %s: %v", pending.Task, pending.Alert.Labels["alertname"], err)
+	}
+}
+
+// recoverPending schedules the alerts parked before Iterator stopped.
+// Alerts whose fire delay elapsed in the meantime are applied at startup.
+func (s *Server) recoverPending() {
+	pending, err := lifecycle.ListPending()
+	if err != nil {
+		log.Error("Failed to list pending alerts: %v", err)
+		return
+	}
+
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+
+	for key, p := range pending {
+		s.schedulePending(key, p.FireAt)
+	}
+}
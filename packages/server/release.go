@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cloudputation/iterator/packages/command"
+	"github.com/cloudputation/iterator/packages/lifecycle"
+	log "github.com/cloudputation/iterator/packages/logger"
+	"github.com/cloudputation/iterator/packages/terraform"
+)
+
+// How long a failed release waits before it is retried
+const releaseRetry = time.Minute
+
+// PendingRelease is a sawtooth deployment waiting for its time-to-live to expire.
+type PendingRelease struct {
+	Key         string    `json:"key"`
+	AlertName   string    `json:"alert_name"`
+	Fingerprint string    `json:"fingerprint"`
+	Task        string    `json:"task"`
+	Module      string    `json:"module"`
+	ReleaseAt   time.Time `json:"release_at"`
+}
+
+// releaseDeadline returns when the deployment of a command for the alert record stored under key is released.
+// A deployment that is already pending keeps its deadline when its alert fires again.
+func releaseDeadline(cmd *command.Command, key string) *time.Time {
+	if cmd.ReleaseAfter == "" {
+		return nil
+	}
+
+	if alertRecord, err := lifecycle.ReadAlert(key); err == nil && alertRecord.ReleaseAt != nil {
+		return alertRecord.ReleaseAt
+	}
+
+	releaseAt := time.Now().Add(cmd.Durations.ReleaseAfter).UTC()
+	return &releaseAt
+}
+
+// scheduleRelease releases the deployment of the alert record stored under key at the given time.
+func (s *Server) scheduleRelease(key string, releaseAt time.Time) {
+	s.releaseMutex.Lock()
+	defer s.releaseMutex.Unlock()
+
+	if timer, ok := s.releaseTimers[key]; ok {
+		timer.Stop()
+	}
+
+	delay := time.Until(releaseAt)
+	log.Info("Releasing alert %s in %s", key, delay.Round(time.Second))
+	s.releaseTimers[key] = time.AfterFunc(delay, func() {
+		s.releaseMutex.Lock()
+		delete(s.releaseTimers, key)
+		s.releaseMutex.Unlock()
+
+		s.runRelease(key)
+	})
+}
+
+// cancelRelease stops the scheduled release of the alert record stored under key, once it was released otherwise.
+func (s *Server) cancelRelease(key string) {
+	s.releaseMutex.Lock()
+	defer s.releaseMutex.Unlock()
+
+	if timer, ok := s.releaseTimers[key]; ok {
+		timer.Stop()
+		delete(s.releaseTimers, key)
+	}
+}
+
+// runRelease destroys a sawtooth deployment whose time-to-live expired.
+func (s *Server) runRelease(key string) {
+	alertRecord, err := lifecycle.ReadAlert(key)
+	if err != nil || alertRecord.ReleaseAt == nil {
+		log.Debug("Alert %s is no longer pending release", key)
+		return
+	}
+
+	// The release is queued behind the run under way for the alert, which may renew the deployment
+	ticket := s.runQueue.Enqueue(lifecycle.LifecycleKey(alertRecord.Task, alertRecord.Fingerprint))
+	ticket.Wait()
+	defer ticket.Done()
+
+	alertRecord, err = lifecycle.ReadAlert(key)
+	if err != nil || alertRecord.ReleaseAt == nil {
+		log.Debug("Alert %s is no longer pending release", key)
+		return
+	}
+
+	if time.Now().Before(*alertRecord.ReleaseAt) {
+		s.scheduleRelease(key, *alertRecord.ReleaseAt)
+		return
+	}
+
+	log.Info("Time-to-live of alert %s expired, releasing it", key)
+	err = lifecycle.HandleSawtoothScheduling(s.initConfig, key, alertRecord)
+	if err != nil {
+		if errors.Is(err, terraform.ErrIntegrity) {
+			s.integrityCounter.WithLabelValues(alertRecord.Task, "destroy").Inc()
+		}
+		log.Error("Failed to release alert %s, retrying in %s: %v", key, releaseRetry, err)
+		s.scheduleRelease(key, time.Now().Add(releaseRetry))
+		return
+	}
+
+	setState(alertRecord.Task, alertRecord.AlertName, alertRecord.Fingerprint, lifecycle.StateReleased, "time-to-live expired")
+	s.startCooldown(alertRecord.Task, alertRecord.Fingerprint, "destroy")
+	s.tellFingers.Close(alertRecord.Fingerprint)
+}
+
+// pendingReleases returns the sawtooth deployments waiting for their time-to-live to expire, the soonest first.
+func pendingReleases() ([]PendingRelease, error) {
+	alerts, err := lifecycle.ListAlerts()
+	if err != nil {
+		return nil, err
+	}
+
+	releases := []PendingRelease{}
+	for key, alertRecord := range alerts {
+		if alertRecord.ReleaseAt == nil {
+			continue
+		}
+		releases = append(releases, PendingRelease{
+			Key:         key,
+			AlertName:   alertRecord.AlertName,
+			Fingerprint: alertRecord.Fingerprint,
+			Task:        alertRecord.Task,
+			Module:      alertRecord.Module,
+			ReleaseAt:   *alertRecord.ReleaseAt,
+		})
+	}
+	sort.Slice(releases, func(i, j int) bool { return releases[i].ReleaseAt.Before(releases[j].ReleaseAt) })
+
+	return releases, nil
+}
+
+// recoverReleases schedules the releases persisted with the alert records,
+// so that deployments whose time-to-live expired while Iterator was stopped are released at startup.
+func (s *Server) recoverReleases() {
+	releases, err := pendingReleases()
+	if err != nil {
+		log.Error("Failed to list pending releases: %v", err)
+		return
+	}
+
+	for _, release := range releases {
+		s.scheduleRelease(release.Key, release.ReleaseAt)
+	}
+}
+
+// handleReleases responds with the sawtooth deployments pending release.
+func (s *Server) handleReleases(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	releases, err := pendingReleases()
+	if err != nil {
+		handleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(releases)
+	if err != nil {
+		handleError(w, err)
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/alertmanager/template"
+
+	"github.com/cloudputation/iterator/packages/command"
+	"github.com/cloudputation/iterator/packages/config"
+	"github.com/cloudputation/iterator/packages/lifecycle"
+	log "github.com/cloudputation/iterator/packages/logger"
+	"github.com/cloudputation/iterator/packages/runqueue"
+	"github.com/cloudputation/iterator/packages/storage"
+)
+
+// How long a test waits for work that is expected to run
+const testTimeout = time.Second
+
+// How long a test watches work that is expected to keep waiting
+const testSettle = 50 * time.Millisecond
+
+const testAlertName, testFingerprint = "Alert1", "fp1"
+
+// newTestServer returns a server running the command, storing its data in a temporary directory.
+func newTestServer(t *testing.T, cmd *command.Command) *Server {
+	dataDir := t.TempDir()
+	err := log.InitLogger(dataDir, "error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	initConfig := &config.InitConfig{Server: &config.Server{DataDir: dataDir}}
+	storage.InitStorage(initConfig)
+
+	return NewServer(initConfig, &config.Config{Commands: []*command.Command{cmd}})
+}
+
+// writeTestAlert writes the record of the test alert, applied by the task from a module
+// that `true` stands in as the Terraform driver for.
+func writeTestAlert(t *testing.T, task string, update func(*lifecycle.Alert)) string {
+	alertKey := lifecycle.AlertKey(testAlertName, testFingerprint)
+	alertRecord := &lifecycle.Alert{
+		Fingerprint:     testFingerprint,
+		AlertName:       testAlertName,
+		Task:            task,
+		Module:          t.TempDir(),
+		TerraformDriver: "true",
+	}
+	if update != nil {
+		update(alertRecord)
+	}
+
+	err := lifecycle.WriteAlert(alertKey, alertRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alertKey
+}
+
+// holdTicket takes the run queue ticket of the test alert, as a run under way for it does
+func holdTicket(t *testing.T, s *Server, task string) *runqueue.Ticket {
+	ticket := s.runQueue.Enqueue(lifecycle.LifecycleKey(task, testFingerprint))
+	ticket.Wait()
+	if !setState(task, testAlertName, testFingerprint, lifecycle.StateApplying, "alert fired") {
+		t.Fatal("failed to start the apply")
+	}
+	return ticket
+}
+
+// assertKept checks that the alert record isn't dropped while the ticket of the alert is held
+func assertKept(t *testing.T, alertKey, work string) {
+	time.Sleep(testSettle)
+	if _, err := lifecycle.ReadAlert(alertKey); err != nil {
+		t.Fatalf("%s ran while the apply of the alert is under way", work)
+	}
+}
+
+// waitDropped waits for the alert record to be dropped once the ticket of the alert is released
+func waitDropped(t *testing.T, alertKey, work string) {
+	deadline := time.Now().Add(testTimeout)
+	for {
+		if _, err := lifecycle.ReadAlert(alertKey); err != nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s didn't run once the apply of the alert was done", work)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestResolveWaitsForRunningApply resolves an alert while its apply is under way,
+// and checks that the record of the alert is only dropped once the apply is done.
+func TestResolveWaitsForRunningApply(t *testing.T) {
+	// The resources are kept on resolve, so that the resolution only drops the alert record
+	keep := false
+	cmd := &command.Command{Task: "Task1", Cmd: "terraform", DestroyOnResolved: &keep}
+	s := newTestServer(t, cmd)
+
+	alertKey := writeTestAlert(t, cmd.Task, nil)
+	ticket := holdTicket(t, s, cmd.Task)
+
+	s.amResolved(template.Alert{
+		Status:      "resolved",
+		Labels:      template.KV{"alertname": testAlertName},
+		Fingerprint: testFingerprint,
+	})
+	assertKept(t, alertKey, "resolution")
+
+	setState(cmd.Task, testAlertName, testFingerprint, lifecycle.StateApplied, "run succeeded")
+	ticket.Done()
+	waitDropped(t, alertKey, "resolution")
+}
+
+// TestResolveCancelsRunningApply checks that an alert resolving while its apply is under way
+// tells the apply to stop, without waiting for it to be done.
+func TestResolveCancelsRunningApply(t *testing.T) {
+	keep := false
+	cmd := &command.Command{Task: "Task1", Cmd: "terraform", DestroyOnResolved: &keep}
+	s := newTestServer(t, cmd)
+
+	alertKey := writeTestAlert(t, cmd.Task, nil)
+	ticket := holdTicket(t, s, cmd.Task)
+	quit := s.tellFingers.Add(testFingerprint)
+
+	s.amResolved(template.Alert{
+		Status:      "resolved",
+		Labels:      template.KV{"alertname": testAlertName},
+		Fingerprint: testFingerprint,
+	})
+
+	select {
+	case <-quit:
+	case <-time.After(testTimeout):
+		t.Fatal("apply under way wasn't told to stop when its alert resolved")
+	}
+
+	// The resolution still waits for the apply to be over
+	assertKept(t, alertKey, "resolution")
+	setState(cmd.Task, testAlertName, testFingerprint, lifecycle.StateCancelled, "run cancelled")
+	ticket.Done()
+	waitDropped(t, alertKey, "resolution")
+}
+
+// TestDelayedDestroyWaitsForRunningApply runs a pending destroy while an apply is under way for its alert,
+// and checks that the destroy only runs once the apply is done.
+func TestDelayedDestroyWaitsForRunningApply(t *testing.T) {
+	cmd := &command.Command{Task: "Task1", Cmd: "terraform", ResolveDelay: "1s"}
+	s := newTestServer(t, cmd)
+
+	destroyAt := time.Now().Add(-time.Second).UTC()
+	alertKey := writeTestAlert(t, cmd.Task, func(alertRecord *lifecycle.Alert) {
+		alertRecord.DestroyAt = &destroyAt
+	})
+	ticket := holdTicket(t, s, cmd.Task)
+
+	go s.runDestroy(alertKey)
+	assertKept(t, alertKey, "delayed destroy")
+
+	setState(cmd.Task, testAlertName, testFingerprint, lifecycle.StateApplied, "run succeeded")
+	ticket.Done()
+	waitDropped(t, alertKey, "delayed destroy")
+}
+
+// TestReleaseWaitsForRunningApply releases a sawtooth deployment while an apply is under way for its alert,
+// and checks that the release only runs once the apply is done.
+func TestReleaseWaitsForRunningApply(t *testing.T) {
+	cmd := &command.Command{Task: "Task1", Cmd: "terraform", TerraformScheduling: "sawtooth", ReleaseAfter: "1s"}
+	s := newTestServer(t, cmd)
+
+	releaseAt := time.Now().Add(-time.Second).UTC()
+	alertKey := writeTestAlert(t, cmd.Task, func(alertRecord *lifecycle.Alert) {
+		alertRecord.TerraformScheduling = "sawtooth"
+		alertRecord.ReleaseAt = &releaseAt
+	})
+	ticket := holdTicket(t, s, cmd.Task)
+
+	go s.runRelease(alertKey)
+	assertKept(t, alertKey, "release")
+
+	setState(cmd.Task, testAlertName, testFingerprint, lifecycle.StateApplied, "run succeeded")
+	ticket.Done()
+	waitDropped(t, alertKey, "release")
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cloudputation/iterator/packages/command"
+	"github.com/cloudputation/iterator/packages/lifecycle"
+	log "github.com/cloudputation/iterator/packages/logger"
+	"github.com/cloudputation/iterator/packages/terraform"
+)
+
+// How long a failed step of a scale command waits before it is retried when no cooldown is configured
+const defaultScaleRetry = 30 * time.Second
+
+// scaleFiring counts a firing alert towards the counter of a scale command,
+// and schedules a step of the counter.
+func (s *Server) scaleFiring(cmd *command.Command, fingerprint string) error {
+	if cmd.Source == "" {
+		return fmt.Errorf("Scale command %s requires a static module source", cmd)
+	}
+
+	return s.updateScale(cmd, func(scale *lifecycle.Scale) bool {
+		if scale.Active[fingerprint] {
+			return false
+		}
+		log.Info("Counting alert %s towards scale task %s", fingerprint, cmd.Task)
+		scale.Active[fingerprint] = true
+		return true
+	})
+}
+
+// scaleResolved stops counting a resolved alert towards the counter of a scale command,
+// and schedules a step of the counter.
+func (s *Server) scaleResolved(cmd *command.Command, fingerprint string) {
+	err := s.updateScale(cmd, func(scale *lifecycle.Scale) bool {
+		if !scale.Active[fingerprint] {
+			return false
+		}
+		log.Info("No longer counting alert %s towards scale task %s", fingerprint, cmd.Task)
+		delete(scale.Active, fingerprint)
+		return true
+	})
+	if err != nil {
+		log.Error("Failed to remove alert %s from scale task %s: %v", fingerprint, cmd.Task, err)
+	}
+}
+
+// updateScale applies a change to the record of a scale command.
+// When the change modified the set of counted alerts, the record is saved and a step is scheduled.
+func (s *Server) updateScale(cmd *command.Command, change func(*lifecycle.Scale) bool) error {
+	s.scaleMutex.Lock()
+	defer s.scaleMutex.Unlock()
+
+	scale, err := lifecycle.ReadScale(cmd.Task)
+	if err != nil {
+		scale = &lifecycle.Scale{
+			Task:   cmd.Task,
+			Active: make(map[string]bool),
+			Count:  cmd.Scale.Min,
+		}
+	}
+
+	if !change(scale) {
+		return nil
+	}
+
+	err = lifecycle.WriteScale(scale)
+	if err != nil {
+		return fmt.Errorf("Failed to save scale task %s: %w", cmd.Task, err)
+	}
+
+	s.scheduleScale(cmd, 0)
+	return nil
+}
+
+// scheduleScale steps the counter of a scale command after the given delay.
+// It must be called with the scale mutex held.
+func (s *Server) scheduleScale(cmd *command.Command, delay time.Duration) {
+	if _, ok := s.scaleTimers[cmd.Task]; ok {
+		return
+	}
+
+	s.scaleTimers[cmd.Task] = time.AfterFunc(delay, func() {
+		s.scaleMutex.Lock()
+		delete(s.scaleTimers, cmd.Task)
+		s.scaleMutex.Unlock()
+
+		s.stepScale(cmd)
+	})
+}
+
+// stepScale moves the counter of a scale command one step towards its target and applies the module with it.
+// Steps are spaced by the command's cooldown, until the counter reaches the target.
+func (s *Server) stepScale(cmd *command.Command) {
+	runLock := s.taskRunLock(cmd.Task)
+	runLock.Lock()
+	defer runLock.Unlock()
+
+	s.scaleMutex.Lock()
+	scale, err := lifecycle.ReadScale(cmd.Task)
+	s.scaleMutex.Unlock()
+	if err != nil {
+		log.Error("Failed to read scale task %s: %v", cmd.Task, err)
+		return
+	}
+
+	target := scale.Target(cmd.Scale.Min, cmd.Scale.Max, cmd.Scale.Step)
+	if scale.Count == target {
+		return
+	}
+
+	cooldown := cmd.Durations.ScaleCooldown
+	if wait := time.Until(scale.LastStep.Add(cooldown)); wait > 0 {
+		s.scaleMutex.Lock()
+		s.scheduleScale(cmd, wait)
+		s.scaleMutex.Unlock()
+		return
+	}
+
+	count := scale.Next(target, cmd.Scale.Step)
+	modulePath, opts, err := s.applyScale(cmd, count)
+	if err != nil {
+		s.errCounter.WithLabelValues(ErrLabelStart).Inc()
+		retry := cooldown
+		if retry == 0 {
+			retry = defaultScaleRetry
+		}
+		log.Error("Failed to scale task %s to %d, retrying in %s: %v", cmd.Task, count, retry, err)
+
+		s.scaleMutex.Lock()
+		s.scheduleScale(cmd, retry)
+		s.scaleMutex.Unlock()
+		return
+	}
+
+	s.scaleMutex.Lock()
+	defer s.scaleMutex.Unlock()
+
+	current, err := lifecycle.ReadScale(cmd.Task)
+	if err != nil {
+		log.Error("Failed to read scale task %s: %v", cmd.Task, err)
+		return
+	}
+	current.Count = count
+	current.LastStep = time.Now().UTC()
+	current.Module = modulePath
+	current.TerraformDriver = cmd.Cmd
+	current.Options = opts
+	err = lifecycle.WriteScale(current)
+	if err != nil {
+		log.Error("Failed to save scale task %s: %v", cmd.Task, err)
+		return
+	}
+
+	if current.Count != current.Target(cmd.Scale.Min, cmd.Scale.Max, cmd.Scale.Step) {
+		s.scheduleScale(cmd, cooldown)
+	}
+}
+
+// applyScale applies the module of a scale command with the given counter value,
+// and returns the absolute path of the module and the options it was applied with.
+func (s *Server) applyScale(cmd *command.Command, count int) (string, terraform.Options, error) {
+	value, err := json.Marshal(count)
+	if err != nil {
+		return "", terraform.Options{}, err
+	}
+
+	opts, err := taskOptions(cmd, cmd.Scale.Variable, value, "scale")
+	if err != nil {
+		return "", opts, err
+	}
+
+	start := time.Now()
+	s.processCurrent.Inc()
+	defer func() {
+		s.processCurrent.Dec()
+		s.processDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	log.Info("Scaling task %s to %d", cmd.Task, count)
+	modulePath, err := s.applyTask(cmd, opts)
+	return modulePath, opts, err
+}
+
+// recoverScales schedules the scale commands whose counter hasn't reached its target,
+// for instance when Iterator stopped between two steps.
+func (s *Server) recoverScales() {
+	scales, err := lifecycle.ListScales()
+	if err != nil {
+		log.Error("Failed to list scale tasks: %v", err)
+		return
+	}
+
+	s.scaleMutex.Lock()
+	defer s.scaleMutex.Unlock()
+
+	for _, scale := range scales {
+		for _, cmd := range s.config.Commands {
+			if !cmd.IsScale() || cmd.Task != scale.Task || cmd.Scale == nil {
+				continue
+			}
+			if scale.Count != scale.Target(cmd.Scale.Min, cmd.Scale.Max, cmd.Scale.Step) {
+				s.scheduleScale(cmd, 0)
+			}
+		}
+	}
+}
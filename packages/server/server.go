@@ -2,7 +2,9 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	l "log"
 	"github.com/prometheus/alertmanager/template"
@@ -23,8 +25,10 @@ import (
 	"github.com/cloudputation/iterator/packages/config"
 	"github.com/cloudputation/iterator/packages/consul"
 	"github.com/cloudputation/iterator/packages/countermap"
+	"github.com/cloudputation/iterator/packages/interpolate"
 	"github.com/cloudputation/iterator/packages/lifecycle"
 	log "github.com/cloudputation/iterator/packages/logger"
+	"github.com/cloudputation/iterator/packages/runqueue"
 	"github.com/cloudputation/iterator/packages/stats"
 	"github.com/cloudputation/iterator/packages/terraform"
 )
@@ -33,6 +37,9 @@ type CommandDetails struct {
     Cmd    string
     Args   []string
 		TerraformScheduling string
+		Options terraform.Options
+		// Commit of the git source checkout the command runs
+		Commit string
 }
 
 const (
@@ -47,6 +54,9 @@ const (
 	CmdRunNoFinger
 	CmdRunFingerUnder
 	CmdRunFingerOver
+	CmdRunNotReady
+	CmdRunFlapping
+	CmdRunCooldown
 )
 
 const (
@@ -67,6 +77,9 @@ var (
 		CmdRunNoFinger:     "No fingerprint found for command",
 		CmdRunFingerUnder:  "Command count for fingerprint is under limit",
 		CmdRunFingerOver:   "Command count for fingerprint is over limit",
+		CmdRunNotReady:     "Terraform module is not initialized",
+		CmdRunFlapping:     "Runs are suspended while the alert flaps",
+		CmdRunCooldown:     "Task is cooling down after an apply or a destroy",
 	}
 
 	// These labels are meant to be applied to prometheus metrics
@@ -76,6 +89,9 @@ var (
 		CmdRunNoFinger:     "nofinger",
 		CmdRunFingerUnder:  "fingerunder",
 		CmdRunFingerOver:   "fingerover",
+		CmdRunNotReady:     "notready",
+		CmdRunFlapping:     "flapping",
+		CmdRunCooldown:     "cooldown",
 	}
 
 	procDurationOpts = prometheus.HistogramOpts{
@@ -114,9 +130,25 @@ var (
 		Help:      "Total number of commands that were skipped instead of run for matching alerts.",
 	}
 
-	errCountLabels  = []string{"stage"}
-	sigCountLabels  = []string{"result"}
-	skipCountLabels = []string{"reason"}
+	integrityCountOpts = prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Subsystem: "integrity_violations",
+		Name:      "total",
+		Help:      "Total number of runs refused because a module didn't match its pinned checksum.",
+	}
+
+	flapGaugeOpts = prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Subsystem: "flapping",
+		Name:      "suspended",
+		Help:      "Alerts whose runs are suspended because they flap.",
+	}
+
+	errCountLabels       = []string{"stage"}
+	sigCountLabels       = []string{"result"}
+	skipCountLabels      = []string{"reason"}
+	integrityCountLabels = []string{"task", "stage"}
+	flapGaugeLabels      = []string{"task", "fingerprint"}
 )
 
 type CmdRunReason int
@@ -144,18 +176,41 @@ type Server struct {
 	sigCounter *prometheus.CounterVec
 	// Track number of commands skipped instead of run.
 	skipCounter *prometheus.CounterVec
+	// Track number of runs refused due to a module checksum mismatch.
+	integrityCounter *prometheus.CounterVec
+	// Track alerts whose runs are suspended because they flap.
+	flapGauge *prometheus.GaugeVec
 	// Map to store the command details indexed by fingerprint
 	commandDetails map[string]CommandDetails
 	commandDetailsMutex sync.Mutex
+	// Pending coalescing timers of aggregate commands, indexed by task
+	aggregateTimers map[string]*time.Timer
+	aggregateMutex  sync.Mutex
+	// Pending steps of scale commands, indexed by task
+	scaleTimers map[string]*time.Timer
+	scaleMutex  sync.Mutex
+	// Pending releases of sawtooth deployments with a time-to-live, indexed by alert record key
+	releaseTimers map[string]*time.Timer
+	releaseMutex  sync.Mutex
+	// Pending lease expiries of alert records, indexed by alert record key
+	leaseTimers map[string]*time.Timer
+	leaseMutex  sync.Mutex
+	// Pending destroys of resolved alerts held back by a resolve delay, indexed by alert record key
+	destroyTimers map[string]*time.Timer
+	destroyMutex  sync.Mutex
+	// Firing alerts parked until the fire delay of their command elapses, indexed by pending key
+	pendingTimers map[string]*time.Timer
+	pendingMutex  sync.Mutex
+	// Checks of the flapping alerts whose runs are suspended, indexed by flap key
+	flapTimers map[string]*time.Timer
+	flapMutex  sync.Mutex
+	// Locks serializing the runs of task level commands, indexed by task
+	taskRuns      map[string]*sync.Mutex
+	taskRunsMutex sync.Mutex
+	// Queue serializing the runs and resolutions of an alert, indexed by lifecycle key
+	runQueue *runqueue.Queue
 }
 
-var (
-	dataDir string
-	terraformScheduling string
-	consulDataDir = config.ConsulFactoryDataDir
-	consulExecutorDir = consulDataDir + "/process/alerts"
-)
-
 // amDataToEnv converts prometheus alert manager template data into key=value strings,
 // which are meant to be set as environment variables of commands called by this program..
 func amDataToEnvForAlert(alert *template.Alert) []string {
@@ -181,7 +236,7 @@ func amDataToEnvForAlert(alert *template.Alert) []string {
 }
 
 // Give default to CommandDetails
-func DefaultCommandDetails(cmd string, args []string, terraformScheduling string) CommandDetails {
+func DefaultCommandDetails(cmd string, args []string, terraformScheduling string, opts terraform.Options) CommandDetails {
 	if terraformScheduling == "" {
 		terraformScheduling = "default"
 	}
@@ -189,6 +244,7 @@ func DefaultCommandDetails(cmd string, args []string, terraformScheduling string
 		Cmd:                 cmd,
 		Args:                args,
 		TerraformScheduling: terraformScheduling,
+		Options:             opts,
 	}
 }
 
@@ -215,7 +271,7 @@ func timeToStr(t time.Time) string {
 // handleError responds to an HTTP request with an error message and logs it
 func handleError(w http.ResponseWriter, err error) {
 	http.Error(w, err.Error(), http.StatusInternalServerError)
-	log.Error("%w", err)
+	log.Error("%v", err)
 }
 
 // handleHealth is meant to respond to health checks for this program
@@ -238,9 +294,15 @@ func (r CmdRunReason) String() string {
 
 // amFiring handles a triggered alert message from alertmanager
 func (s *Server) amFiring(alert *template.Alert) []error {
+	return s.fireCommands(alert, s.config.Commands, false)
+}
+
+// fireCommands runs the given commands for a firing alert.
+// Commands with a fire delay park the alert instead, unless its delay elapsed.
+func (s *Server) fireCommands(alert *template.Alert, commands []*command.Command, delayElapsed bool) []error {
 	var wg sync.WaitGroup
 	var allErrors = make([]error, 0)
-	env := amDataToEnvForAlert(alert)
+	env := append(amDataToEnvForAlert(alert), terraform.Env()...)
 
 	type future struct {
 		cmd *command.Command
@@ -263,7 +325,27 @@ func (s *Server) amFiring(alert *template.Alert) []error {
 		}
 	}
 
-	for _, cmd := range s.config.Commands {
+	for _, cmd := range commands {
+		// Every firing notification renews the lease, including those of commands that can't run again yet
+		if cmd.Lease != nil && cmd.Matches(alert) {
+			s.renewLease(cmd, alert)
+		}
+
+		// The alert firing again keeps its resources, even when the command can't run for it yet
+		if cmd.ResolveDelay != "" && cmd.Matches(alert) {
+			if fingerprint, ok := cmd.Fingerprint(alert); ok {
+				s.cancelDestroy(lifecycle.AlertKey(alert.Labels["alertname"], fingerprint))
+			}
+		}
+
+		// Every transition counts towards flapping, including those of alerts the command can't run for yet
+		flapping := false
+		if cmd.FlapDetection != nil && cmd.Matches(alert) {
+			if fingerprint, ok := cmd.Fingerprint(alert); ok {
+				flapping = s.trackFlap(cmd, alert, fingerprint)
+			}
+		}
+
 		ok, reason := s.CanRun(cmd, alert)
 		if !ok {
 			log.Info("Skipping command due to '%s': %s", reason, cmd)
@@ -279,8 +361,108 @@ func (s *Server) amFiring(alert *template.Alert) []error {
 			continue
 		}
 
-		log.Info("Setting commandDetails for fingerprint: %s, command: %s, args: %v", fingerprint, cmd.Cmd, cmd.Args)
-		commandDetails := DefaultCommandDetails(cmd.Cmd, cmd.Args, cmd.TerraformScheduling)
+		if flapping {
+			log.Warn("Skipping command for alert %s, it is flapping: %s", alert.Labels["alertname"], cmd)
+			s.skipCounter.WithLabelValues(CmdRunFlapping.Label()).Inc()
+			continue
+		}
+
+		if !delayElapsed && s.parkAlert(cmd, alert, fingerprint) {
+			continue
+		}
+
+		if cmd.IsAggregate() {
+			err := s.aggregateFiring(cmd, alert, fingerprint)
+			if err != nil {
+				allErrors = append(allErrors, err)
+			}
+			continue
+		}
+
+		if cmd.IsScale() {
+			err := s.scaleFiring(cmd, fingerprint)
+			if err != nil {
+				allErrors = append(allErrors, err)
+			}
+			continue
+		}
+
+		if cmd.IsEscalation() {
+			err := s.escalationFiring(cmd, alert, fingerprint)
+			if err != nil {
+				allErrors = append(allErrors, err)
+			}
+			continue
+		}
+
+		// Runs for the alert are serialized with its resolutions, until its record is written
+		ticket := s.runQueue.Enqueue(lifecycle.LifecycleKey(cmd.Task, fingerprint))
+		ticket.Wait()
+
+		alertName := alert.Labels["alertname"]
+		running, _ := runStates(cmd)
+		if !setState(cmd.Task, alertName, fingerprint, running, "alert fired") {
+			ticket.Done()
+			log.Info("Skipping command for alert %s, its lifecycle doesn't allow a run: %s", alertName, cmd)
+			continue
+		}
+		// The module isn't re-initialized while the run is in flight
+		release := func() {}
+		fail := func(err error) {
+			allErrors = append(allErrors, err)
+			setState(cmd.Task, alertName, fingerprint, lifecycle.StateFailed, err.Error())
+			release()
+			ticket.Done()
+		}
+
+		source, err := moduleSource(cmd, alert)
+		if err != nil {
+			fail(err)
+			continue
+		}
+
+		if source != "" {
+			err := terraform.EnsureInit(cmd.Cmd, source)
+			if err != nil {
+				fail(fmt.Errorf("Failed to initialize Terraform module %s: %w", source, err))
+				continue
+			}
+			release = terraform.AcquireModule(source)
+		}
+
+		if cmd.ForEach != "" {
+			allErrors = append(allErrors, s.fanOut(cmd, alert, fingerprint, source, env)...)
+			release()
+			ticket.Done()
+			continue
+		}
+
+		runCmd, opts, err := prepareCommand(cmd, alert, fingerprint, source, "")
+		if err != nil {
+			fail(err)
+			continue
+		}
+
+		if cmd.ResolveDelay != "" {
+			s.handOverDestroys(cmd, fingerprint, runCmd.Source, opts.Workspace)
+		}
+
+		err = terraform.VerifyModule(runCmd.Source, runCmd.SourceChecksum)
+		if err != nil {
+			s.reportIntegrityViolation(runCmd, fingerprint, alert, err)
+			fail(err)
+			continue
+		}
+
+		err = terraform.PrepareModule(runCmd.Cmd, runCmd.Source, opts)
+		if err != nil {
+			fail(fmt.Errorf("Failed to prepare Terraform module %s: %w", runCmd.Source, err))
+			continue
+		}
+
+		log.Info("Setting commandDetails for fingerprint: %s, command: %s, args: %v", fingerprint, runCmd.Cmd, runCmd.Args)
+		commandDetails := DefaultCommandDetails(runCmd.Cmd, runCmd.Args, runCmd.TerraformScheduling, opts)
+		commandDetails.Commit = terraform.ModuleCommit(source)
 
 		s.commandDetailsMutex.Lock()
 		s.commandDetails[fingerprint] = commandDetails
@@ -288,9 +470,11 @@ func (s *Server) amFiring(alert *template.Alert) []error {
 
 		out := make(chan command.CommandResult)
 		wg.Add(1)
-		go collect(future{cmd: cmd, out: out})
+		go collect(future{cmd: runCmd, out: out})
 
-		err := s.instrument(fingerprint, cmd, env, out, *alert)
+		err = s.instrument(fingerprint, runCmd, runEnv(env, opts), out, *alert)
+		release()
+		ticket.Done()
 		if err != nil {
 			allErrors = append(allErrors, err)
 			continue
@@ -310,98 +494,489 @@ func (s *Server) amFiring(alert *template.Alert) []error {
 }
 
 
-// amResolved handles a resolved alert message from alertmanager
-func (s *Server) amResolved(alert template.Alert) {
-	dataDir := s.initConfig.Server.DataDir
-	executorDir := fmt.Sprintf("%s/process/alerts", dataDir)
-	alertname := alert.Labels["alertname"]
+// reportIntegrityViolation counts an apply refused due to a module checksum mismatch,
+// and records the violation on the alert record.
+func (s *Server) reportIntegrityViolation(cmd *command.Command, fingerprint string, alert *template.Alert, violation error) {
+	log.Error("Refusing to apply module %s for alert %s: %v", cmd.Source, alert.Labels["alertname"], violation)
+	s.integrityCounter.WithLabelValues(cmd.Task, "apply").Inc()
 
-	for _, cmd := range s.config.Commands {
-		var alertParameters struct {
-			Fingerprint        string `json:"fingerprint"`
-			Module             string `json:"module"`
-			TerraformDriver		 string `json:"terraform_driver"`
-			TerraformScheduling string `json:"terraform_scheduling"`
+	alertName := alert.Labels["alertname"]
+	alertKey := lifecycle.AlertKey(alertName, fingerprint)
+	alertRecord, err := lifecycle.ReadAlert(alertKey)
+	if err != nil {
+		alertRecord = &lifecycle.Alert{
+			Fingerprint:         fingerprint,
+			AlertName:           alertName,
+			Task:                cmd.Task,
+			Module:              cmd.Source,
+			TerraformDriver:     cmd.Cmd,
+			TerraformScheduling: cmd.TerraformScheduling,
 		}
+	}
+	alertRecord.IntegrityError = violation.Error()
 
-		fingerprint, ok := cmd.Fingerprint(&alert)
-		if !ok || fingerprint == "" {
-			continue
+	err = lifecycle.WriteAlert(alertKey, alertRecord)
+	if err != nil {
+		log.Error("Failed to record integrity violation for alert %s: %v", alertName, err)
+	}
+}
+
+// moduleSource returns the module directory a command runs for an alert, rendering templated sources.
+func moduleSource(cmd *command.Command, alert *template.Alert) (string, error) {
+	if cmd.SourceTemplate == "" {
+		return terraform.TaskSource(cmd.Task, cmd.Source), nil
+	}
+
+	source, err := terraform.ResolveSource(cmd.Task, cmd.SourceTemplate, cmd.AllowedSources, alert)
+	if err != nil {
+		return "", fmt.Errorf("Failed to resolve module source of command %s for alert %s: %w", cmd, alert.Labels["alertname"], err)
+	}
+
+	return source, nil
+}
+
+// prepareCommand returns a copy of the command pointed at the module source,
+// with the Terraform options rendered for the alert appended to its arguments.
+// Inverse commands are turned into a destroy of the module.
+// The options of a fan-out command are rendered for the given element.
+// Commands using working copies are pointed at the copy of their module for the alert fingerprint, or for the element.
+func prepareCommand(cmd *command.Command, alert *template.Alert, fingerprint, source, element string) (*command.Command, terraform.Options, error) {
+	exprs := terraform.Expressions{
+		Targets:       cmd.Targets,
+		Replace:       cmd.Replace,
+		RefreshOnly:   cmd.RefreshOnly,
+		BackendConfig: cmd.BackendConfig,
+		Variables:     cmd.Variables,
+		Workspace:     cmd.Workspace,
+	}
+
+	runID := fingerprint
+	var opts terraform.Options
+	var err error
+	if element != "" {
+		runID = terraform.ElementID(fingerprint, element)
+		opts, err = terraform.NewElementOptions(exprs, alert, element)
+	} else {
+		opts, err = terraform.NewOptions(exprs, alert)
+	}
+	if err != nil {
+		return nil, opts, fmt.Errorf("Failed to render Terraform options of command %s for alert %s: %w", cmd, alert.Labels["alertname"], err)
+	}
+
+	opts.Checksum = cmd.SourceChecksum
+	if len(opts.Variables) > 0 {
+		opts.VarFile, err = terraform.VarFilePath(cmd.Task, runID)
+		if err != nil {
+			return nil, opts, err
 		}
+	}
 
-		fingerprintFilePath := fmt.Sprintf("%s/%s.json", executorDir, fingerprint)
+	runCmd := *cmd
+	terraformCommand := cmd.FiringCommand()
+	runCmd.Args = append([]string{}, cmd.Args...)
+	for i, arg := range runCmd.Args {
+		if arg == "apply" {
+			runCmd.Args[i] = terraformCommand
+			break
+		}
+	}
+	runCmd.Args = append(runCmd.Args, opts.Args(terraformCommand)...)
+	if source != cmd.Source {
+		runCmd.Source = source
+		runCmd.Args[0] = config.ModuleDirArg(cmd.Cmd, source)
+	}
 
-		switch {
-		case config.ConsulStorageEnabled:
-			kvPath := fmt.Sprintf("%s/%s", consulExecutorDir, alertname)
-			data, err := consul.ConsulStoreGet(kvPath)
-			if err != nil {
-				log.Error("Failed to get Fingerprint data from Consul: %w", err)
-				continue
-			}
-			err = json.Unmarshal(data, &alertParameters)
-			if err != nil {
-				log.Error("Failed to unmarshal fingerprint data: %w", err)
-				continue
-			}
+	if cmd.WorkingCopy {
+		copyDir, dataDir, err := terraform.WorkingCopy(cmd.Task, runID, source)
+		if err != nil {
+			return nil, opts, err
+		}
+		opts.DataDir = dataDir
+		runCmd.Source = copyDir
+		runCmd.Args[0] = config.ModuleDirArg(cmd.Cmd, copyDir)
+	}
 
-		default:
-			if _, err := os.Stat(fingerprintFilePath); os.IsNotExist(err) {
-				log.Error("Fingerprint file not found: %s", fingerprintFilePath)
-				continue
-			}
+	err = opts.IsolateBackend(cmd.Task, runID)
+	if err != nil {
+		return nil, opts, err
+	}
 
-			fileContent, err := os.ReadFile(fingerprintFilePath)
-			if err != nil {
-				log.Error("Failed to read fingerprint file: %w", err)
-				continue
+	return &runCmd, opts, nil
+}
+
+// fanOut applies a command once per element of its for_each list,
+// and records the run of every element under the alert fingerprint.
+func (s *Server) fanOut(cmd *command.Command, alert *template.Alert, fingerprint, source string, env []string) []error {
+	alertName := alert.Labels["alertname"]
+
+	elements, err := forEachElements(cmd, alert)
+	if err != nil {
+		return []error{err}
+	}
+	log.Info("Applying command %s for alert %s across %d elements: %s", cmd, alertName, len(elements), strings.Join(elements, ", "))
+
+	modulePath, err := filepath.Abs(source)
+	if err != nil {
+		return []error{fmt.Errorf("Failed to get absolute path of module %s: %w", source, err)}
+	}
+
+	terraformScheduling := cmd.TerraformScheduling
+	if terraformScheduling == "" {
+		terraformScheduling = "default"
+	}
+
+	alertRecord := &lifecycle.Alert{
+		Fingerprint:         fingerprint,
+		AlertName:           alertName,
+		Task:                cmd.Task,
+		Module:              modulePath,
+		TerraformDriver:     cmd.Cmd,
+		TerraformScheduling: terraformScheduling,
+		Commit:              terraform.ModuleCommit(source),
+		Elements:            make([]lifecycle.Element, len(elements)),
+	}
+	for i, element := range elements {
+		alertRecord.Elements[i] = lifecycle.Element{Value: element, Result: lifecycle.ElementSkipped}
+	}
+
+	var mu sync.Mutex
+	var allErrors []error
+	run := func(element *lifecycle.Element) bool {
+		errs := s.runElement(cmd, alert, fingerprint, source, env, element)
+		mu.Lock()
+		allErrors = append(allErrors, errs...)
+		mu.Unlock()
+		return element.Result == lifecycle.ElementOk
+	}
+
+	if cmd.Rollout == "sequential" {
+		for i := range alertRecord.Elements {
+			if !run(&alertRecord.Elements[i]) && cmd.HaltOnFailure {
+				log.Warn("Halting rollout of command %s for alert %s, element %s failed", cmd, alertName, elements[i])
+				break
 			}
-			err = json.Unmarshal(fileContent, &alertParameters)
-			if err != nil {
-				log.Error("Failed to unmarshal fingerprint data: %w", err)
-				continue
+		}
+	} else {
+		var wg sync.WaitGroup
+		for i := range alertRecord.Elements {
+			wg.Add(1)
+			go func(element *lifecycle.Element) {
+				defer wg.Done()
+				run(element)
+			}(&alertRecord.Elements[i])
+		}
+		wg.Wait()
+	}
+
+	succeeded := 0
+	for _, element := range alertRecord.Elements {
+		if element.Result == lifecycle.ElementOk {
+			succeeded++
+		}
+	}
+	_, done := runStates(cmd)
+	if succeeded > 0 {
+		s.startCooldown(cmd.Task, fingerprint, cmd.FiringCommand())
+		setState(cmd.Task, alertName, fingerprint, done, fmt.Sprintf("%d of %d elements succeeded", succeeded, len(elements)))
+	} else {
+		setState(cmd.Task, alertName, fingerprint, lifecycle.StateFailed, "no element succeeded")
+	}
+
+	alertKey := lifecycle.AlertKey(alertName, fingerprint)
+	alertRecord.ReleaseAt = releaseDeadline(cmd, alertKey)
+	alertRecord.Labels = copyLabels(alert.Labels)
+	alertRecord.LeaseExpiresAt = leaseDeadline(cmd)
+	err = lifecycle.WriteAlert(alertKey, alertRecord)
+	if err != nil {
+		allErrors = append(allErrors, fmt.Errorf("Failed to register fingerprint: %w", err))
+	} else {
+		if alertRecord.ReleaseAt != nil {
+			s.scheduleRelease(alertKey, *alertRecord.ReleaseAt)
+		}
+		if alertRecord.LeaseExpiresAt != nil {
+			s.scheduleLease(alertKey, *alertRecord.LeaseExpiresAt)
+		}
+	}
+
+	return allErrors
+}
+
+// runElement applies a fan-out command for one of its elements, and fills in the run of the element.
+func (s *Server) runElement(cmd *command.Command, alert *template.Alert, fingerprint, source string, env []string, element *lifecycle.Element) []error {
+	element.Result = lifecycle.ElementFailed
+	fail := func(err error) []error {
+		element.Error = err.Error()
+		return []error{err}
+	}
+
+	runCmd, opts, err := prepareCommand(cmd, alert, fingerprint, source, element.Value)
+	if err != nil {
+		return fail(err)
+	}
+	element.Options = opts
+	element.Module, err = filepath.Abs(runCmd.Source)
+	if err != nil {
+		return fail(fmt.Errorf("Failed to get absolute path of module %s: %w", runCmd.Source, err))
+	}
+
+	err = terraform.VerifyModule(runCmd.Source, runCmd.SourceChecksum)
+	if err != nil {
+		log.Error("Refusing to apply module %s for element %s of alert %s: %v", runCmd.Source, element.Value, alert.Labels["alertname"], err)
+		s.integrityCounter.WithLabelValues(cmd.Task, "apply").Inc()
+		return fail(err)
+	}
+
+	err = terraform.PrepareModule(runCmd.Cmd, runCmd.Source, opts)
+	if err != nil {
+		return fail(fmt.Errorf("Failed to prepare Terraform module %s for element %s: %w", runCmd.Source, element.Value, err))
+	}
+
+	out := make(chan command.CommandResult)
+	forwarded := make(chan struct{})
+	var errs []error
+	go func() {
+		defer close(forwarded)
+		for result := range out {
+			if result.Kind.Has(command.CmdFail) && result.Err != nil && runCmd.ShouldNotify() {
+				errs = append(errs, result.Err)
 			}
 		}
+	}()
+
+	log.Info("Executing Terraform module: %s for element %s of alert: %s", runCmd.Args, element.Value, alert.Labels["alertname"])
+	resultState := s.execute(fingerprint, runCmd, runEnv(env, opts), out)
+	<-forwarded
+	if s.config.Verbose {
+		log.Info("Command: %s, element: %s, result: %s", runCmd.String(), element.Value, resultState)
+	}
+
+	if !resultState.Has(command.CmdOk) {
+		element.Error = fmt.Sprintf("command finished with result %s", resultState)
+		return errs
+	}
 
-		if alertParameters.TerraformScheduling == "sawtooth" {
-			log.Info("Terraform scheduling mode is set to sawtooth for alert: %s. Skipping destroy...", alertname)
+	element.Result = lifecycle.ElementOk
+	if cmd.IsInverse() {
+		return errs
+	}
+	element.Outputs = s.readOutputs(cmd, runCmd.Cmd, element.Module, opts, fingerprint+"/"+element.Value)
+
+	return errs
+}
+
+// runEnv returns the environment of a run: the alert environment followed by the environment of its options.
+// The alert environment is shared by the runs of every element of a fan-out, so each run gets a copy of its own.
+func runEnv(env []string, opts terraform.Options) []string {
+	return append(append([]string(nil), env...), opts.Env()...)
+}
+
+// forEachElements evaluates the for_each list of a command against an alert.
+// Empty and duplicate elements are left out.
+func forEachElements(cmd *command.Command, alert *template.Alert) ([]string, error) {
+	values, err := interpolate.Strings(cmd.ForEach, alert)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to render for_each of command %s for alert %s: %w", cmd, alert.Labels["alertname"], err)
+	}
+
+	seen := make(map[string]bool, len(values))
+	var elements []string
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" || seen[value] {
 			continue
 		}
+		seen[value] = true
+		elements = append(elements, value)
+	}
 
-		modulePath := alertParameters.Module
-		if modulePath == "" {
-			log.Error("Module path is empty in fingerprint file")
+	if len(elements) == 0 {
+		return nil, fmt.Errorf("for_each of command %s is empty for alert %s", cmd, alert.Labels["alertname"])
+	}
+
+	return elements, nil
+}
+
+// amResolved handles a resolved alert message from alertmanager
+func (s *Server) amResolved(alert template.Alert) {
+	alertname := alert.Labels["alertname"]
+
+	for _, cmd := range s.config.Commands {
+		fingerprint, ok := cmd.Fingerprint(&alert)
+		if !ok || fingerprint == "" {
+			continue
+		}
+
+		if cmd.IsAggregate() {
+			s.aggregateResolved(cmd, fingerprint)
 			continue
 		}
 
-		destroy := true
-		if cmd.DestroyOnResolved != nil {
-			destroy = *cmd.DestroyOnResolved
+		if cmd.IsScale() {
+			s.scaleResolved(cmd, fingerprint)
+			continue
 		}
 
-		if destroy {
-			terraformDriver := alertParameters.TerraformDriver
-			go terraform.RunTerraform(terraformDriver, modulePath, "destroy")
+		if cmd.IsEscalation() {
+			s.escalationResolved(cmd, &alert, fingerprint)
+			continue
 		}
 
-		switch {
-		case config.ConsulStorageEnabled:
-			kvPath := fmt.Sprintf("%s/%s", consulExecutorDir, alertname)
-			err := consul.ConsulStoreDelete(kvPath)
-			if err != nil {
-				log.Error("Failed to delete key from Consul: %w", err)
-				continue
-			}
+		flapping := cmd.FlapDetection != nil && cmd.Matches(&alert) && s.trackFlap(cmd, &alert, fingerprint)
+
+		if cmd.FireDelay != "" && s.unparkAlert(cmd, &alert, fingerprint) {
+			continue
+		}
+
+		if flapping {
+			log.Warn("Skipping resolution of alert %s, it is flapping: %s", alertname, cmd)
+			s.skipCounter.WithLabelValues(CmdRunFlapping.Label()).Inc()
+			continue
+		}
+
+		s.queueResolve(cmd, alert, fingerprint)
+	}
+}
+
+// queueResolve resolves an alert for a command once the run under way for the alert, if any, is over.
+func (s *Server) queueResolve(cmd *command.Command, alert template.Alert, fingerprint string) {
+	alertname := alert.Labels["alertname"]
+
+	// Resolutions are queued behind the run under way for the alert, so that its record is written before it is destroyed
+	ticket := s.runQueue.Enqueue(lifecycle.LifecycleKey(cmd.Task, fingerprint))
+	if state := lifecycle.CurrentState(cmd.Task, fingerprint); state.InProgress() {
+		log.Info("Alert %s resolved while %s for task %s, resolving it once the run is over", alertname, state, cmd.Task)
+		// The run under way is cancelled if the command has a resolved signal
+		s.tellFingers.Close(fingerprint)
+	}
+
+	go func() {
+		ticket.Wait()
+		defer ticket.Done()
+		s.resolveAlert(cmd, alert, fingerprint)
+	}()
+}
+
+// resolveAlert destroys the resources a command applied for a resolved alert, or restores those it destroyed.
+// It must be called with the run queue ticket of the alert.
+func (s *Server) resolveAlert(cmd *command.Command, alert template.Alert, fingerprint string) {
+	alertname := alert.Labels["alertname"]
+
+	state := lifecycle.CurrentState(cmd.Task, fingerprint)
+	if state == lifecycle.StateReleased || (state == lifecycle.StateDestroyed && !cmd.IsInverse()) {
+		log.Info("Alert %s is %s for task %s, nothing to resolve", alertname, state, cmd.Task)
+		return
+	}
+
+	alertKey := lifecycle.AlertKey(alertname, fingerprint)
+	alertParameters, err := lifecycle.ReadAlert(alertKey)
+	if err != nil {
+		log.Error("Failed to get fingerprint data: %v", err)
+		return
+	}
+
+	if alertParameters.TerraformScheduling == "sawtooth" {
+		log.Info("Terraform scheduling mode is set to sawtooth for alert: %s. Skipping destroy...", alertname)
+		return
+	}
 
-		default:
-			err := os.Remove(fingerprintFilePath)
+	modulePath := alertParameters.Module
+	if modulePath == "" {
+		log.Error("Module path is empty in fingerprint file")
+		return
+	}
+
+	// Inverse commands destroyed the module when the alert fired, and restore it once it resolves
+	if alertParameters.TerraformScheduling == command.SchedulingInverse {
+		err = lifecycle.VerifyAlert(alertParameters)
+		if err != nil {
+			log.Error("Refusing to restore module %s for alert %s: %v", modulePath, alertname, err)
+			s.integrityCounter.WithLabelValues(alertParameters.Task, "apply").Inc()
+			alertParameters.IntegrityError = err.Error()
+			err = lifecycle.WriteAlert(alertKey, alertParameters)
 			if err != nil {
-				log.Error("Failed to delete fingerprint file: %w", err)
-				continue
+				log.Error("Failed to record integrity violation for alert %s: %v", alertname, err)
 			}
+			return
 		}
 
-		s.tellFingers.Close(fingerprint)
+		if !setState(alertParameters.Task, alertname, fingerprint, lifecycle.StateApplying, "alert resolved") {
+			log.Info("Skipping restore of alert %s, its lifecycle doesn't allow it: %s", alertname, cmd)
+			return
+		}
+		err = lifecycle.RestoreAlert(alertParameters.TerraformDriver, alertParameters)
+		if err != nil {
+			log.Error("Failed to restore module %s for alert %s, keeping its record for a release: %v", modulePath, alertname, err)
+			setState(alertParameters.Task, alertname, fingerprint, lifecycle.StateFailed, err.Error())
+			return
+		}
+		setState(alertParameters.Task, alertname, fingerprint, lifecycle.StateApplied, "module restored")
+		s.startCooldown(alertParameters.Task, fingerprint, "apply")
+	}
+
+	destroy := alertParameters.TerraformScheduling != command.SchedulingInverse
+	if destroy && cmd.DestroyOnResolved != nil {
+		destroy = *cmd.DestroyOnResolved
+	}
+
+	if destroy {
+		if !s.verifyDestroy(alertKey, alertParameters) {
+			return
+		}
+
+		if delay := cmd.Durations.ResolveDelay; delay > 0 {
+			s.deferDestroy(alertKey, alertParameters, delay)
+			return
+		}
+
+		if !setState(alertParameters.Task, alertname, fingerprint, lifecycle.StateDestroying, "alert resolved") {
+			log.Info("Skipping destroy of alert %s, its lifecycle doesn't allow it: %s", alertname, cmd)
+			return
+		}
+		err = lifecycle.DestroyAlert(alertParameters.TerraformDriver, alertParameters)
+		if err != nil {
+			log.Error("Failed to destroy module %s for alert %s, keeping its record for a release: %v", modulePath, alertname, err)
+			setState(alertParameters.Task, alertname, fingerprint, lifecycle.StateFailed, err.Error())
+			return
+		}
+		setState(alertParameters.Task, alertname, fingerprint, lifecycle.StateDestroyed, "module destroyed")
+		s.startCooldown(alertParameters.Task, fingerprint, "destroy")
+	}
+
+	err = lifecycle.DeleteAlert(alertKey)
+	if err != nil {
+		log.Error("Failed to delete fingerprint data: %v", err)
+		return
+	}
+	if !destroy {
+		lifecycle.DiscardAlert(alertParameters)
+	}
+
+	s.tellFingers.Close(fingerprint)
+}
+
+// handleAlert responds with the record Iterator keeps for an alert fingerprint.
+func (s *Server) handleAlert(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fingerprint := strings.TrimPrefix(req.URL.Path, "/api/v1/alerts/")
+	if fingerprint == "" || strings.Contains(fingerprint, "/") {
+		http.Error(w, "alert fingerprint is required", http.StatusBadRequest)
+		return
+	}
+
+	alertRecord, err := lifecycle.FindAlert(fingerprint)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(alertRecord)
+	if err != nil {
+		handleError(w, err)
 	}
 }
 
@@ -493,6 +1068,9 @@ func (s *Server) initMetrics() error {
 	_ = s.sigCounter.WithLabelValues(SigLabelFail)
 	_ = s.skipCounter.WithLabelValues(CmdRunNoLabelMatch.Label())
 	_ = s.skipCounter.WithLabelValues(CmdRunFingerOver.Label())
+	_ = s.skipCounter.WithLabelValues(CmdRunNotReady.Label())
+	_ = s.skipCounter.WithLabelValues(CmdRunFlapping.Label())
+	_ = s.skipCounter.WithLabelValues(CmdRunCooldown.Label())
 
 	return nil
 }
@@ -503,29 +1081,103 @@ func (s *Server) initMetrics() error {
 // The prometheus structs use sync/atomic in methods like Dec and Observe,
 // so they're safe to call concurrently from goroutines.
 func (s *Server) instrument(fingerprint string, cmd *command.Command, env []string, out chan<- command.CommandResult, alert template.Alert) error {
-	dataDir := "./data"
-	if s.initConfig != nil && s.initConfig.Server != nil && s.initConfig.Server.DataDir != "" {
-		dataDir = s.initConfig.Server.DataDir
-	}
-	executorDir := fmt.Sprintf("%s/process/alerts", dataDir)
 	alertName := alert.Labels["alertname"]
 
+	resultState := s.execute(fingerprint, cmd, env, out)
+
+	_, done := runStates(cmd)
+	switch {
+	case resultState.Has(command.CmdOk):
+		setState(cmd.Task, alertName, fingerprint, done, "run succeeded")
+	case resultState.Has(command.CmdSigOk):
+		setState(cmd.Task, alertName, fingerprint, lifecycle.StateCancelled, "interrupted by the resolved signal")
+	default:
+		setState(cmd.Task, alertName, fingerprint, lifecycle.StateFailed, "run failed")
+	}
+
+	s.commandDetailsMutex.Lock()
+	commandDetails, exists := s.commandDetails[fingerprint]
+	s.commandDetailsMutex.Unlock()
+
+	if !exists || len(commandDetails.Args) == 0 {
+		log.Error("Command details not found or empty for fingerprint: %s, current map: %+v", fingerprint, s.commandDetails)
+		return fmt.Errorf("Command details not found or empty for fingerprint: %s", fingerprint)
+	}
+
+	terraformDriver := commandDetails.Cmd
+	terraformScheduling := commandDetails.TerraformScheduling
+
+	// The module directory the command ran on, as resolved for this alert
+	modulePath, err := filepath.Abs(cmd.Source)
+	if err != nil {
+		log.Fatal("Failed to get absolute path: %v", err)
+	}
+
+	alertRecord := &lifecycle.Alert{
+		Fingerprint:         fingerprint,
+		AlertName:           alertName,
+		Task:                cmd.Task,
+		Module:              modulePath,
+		TerraformDriver:     terraformDriver,
+		TerraformScheduling: terraformScheduling,
+		Options:             commandDetails.Options,
+		Commit:              commandDetails.Commit,
+	}
+
+	if resultState.Has(command.CmdOk) && !cmd.IsInverse() {
+		s.collectOutputs(cmd, alertRecord)
+	}
+	if resultState.Has(command.CmdOk) {
+		s.startCooldown(cmd.Task, fingerprint, cmd.FiringCommand())
+	}
+
+	if config.ConsulStorageEnabled {
+		log.Info("Using Consul as storage backend for alert: %s", alertName)
+	} else {
+		log.Info("Using defaut storage backend for alert: %s", alertName)
+	}
+	alertKey := lifecycle.AlertKey(alertName, fingerprint)
+	alertRecord.ReleaseAt = releaseDeadline(cmd, alertKey)
+	alertRecord.Labels = copyLabels(alert.Labels)
+	alertRecord.LeaseExpiresAt = leaseDeadline(cmd)
+	err = lifecycle.WriteAlert(alertKey, alertRecord)
+	if err != nil {
+		return fmt.Errorf("Failed to register fingerprint: %w", err)
+	}
+	if alertRecord.ReleaseAt != nil {
+		s.scheduleRelease(alertKey, *alertRecord.ReleaseAt)
+	}
+	if alertRecord.LeaseExpiresAt != nil {
+		s.scheduleLease(alertKey, *alertRecord.LeaseExpiresAt)
+	}
+
+	return nil
+}
+
+// execute runs a command for an alert fingerprint, forwarding its results to out,
+// and returns the combined result state once the command completed.
+func (s *Server) execute(fingerprint string, cmd *command.Command, env []string, out chan<- command.CommandResult) command.Result {
 	s.processCurrent.Inc()
 	defer s.processCurrent.Dec()
 
+
 	var quit chan struct{}
-		if len(fingerprint) > 0 {
+	if len(fingerprint) > 0 {
 		quit = s.tellFingers.Add(fingerprint)
 		s.fingerCount.Inc(fingerprint)
 		defer s.fingerCount.Dec(fingerprint)
 	}
 
 	done := make(chan struct{})
+	forwarded := make(chan struct{})
 	cmdOut := make(chan command.CommandResult)
 
+	var resultState command.Result
 	go func() {
+		defer close(forwarded)
 		defer close(out)
 		for r := range cmdOut {
+			resultState |= r.Kind
 			if r.Kind.Has(command.CmdFail) && r.Err != nil && cmd.ShouldNotify() {
 				s.errCounter.WithLabelValues(ErrLabelStart).Inc()
 			}
@@ -541,70 +1193,45 @@ func (s *Server) instrument(fingerprint string, cmd *command.Command, env []stri
 
 	start := time.Now()
 	log.Debug("Running command for alert fingerprint: %s", fingerprint)
-	cmd.Run(out, quit, done, env...)
+	cmd.Run(cmdOut, quit, done, env...)
 	<-done
+	<-forwarded
 	s.processDuration.Observe(time.Since(start).Seconds())
 
+	return resultState
+}
 
-	s.commandDetailsMutex.Lock()
-	commandDetails, exists := s.commandDetails[fingerprint]
-	s.commandDetailsMutex.Unlock()
-
-	if !exists || len(commandDetails.Args) == 0 {
-		log.Error("Command details not found or empty for fingerprint: %s, current map: %+v", fingerprint, s.commandDetails)
-		return fmt.Errorf("Command details not found or empty for fingerprint: %s", fingerprint)
-	}
-
-	var modulePath string
-	var terraformDriver string
-	var terraformScheduling string
-
-	terraformDriver = commandDetails.Cmd
-	terraformScheduling = commandDetails.TerraformScheduling
-	chdirArg := commandDetails.Args[0]
-
-	switch {
-	case terraformDriver == "terraform":
-		modulePath = chdirArg[len("-chdir="):]
-	case terraformDriver == "terragrunt":
-		modulePath = chdirArg[len("--terragrunt-working-dir "):]
-	}
+// collectOutputs reads the Terraform outputs of an applied module into the alert record,
+// and publishes them to Consul when the command defines an outputs path.
+func (s *Server) collectOutputs(cmd *command.Command, alertRecord *lifecycle.Alert) {
+	alertRecord.Outputs = s.readOutputs(cmd, alertRecord.TerraformDriver, alertRecord.Module, alertRecord.Options, alertRecord.Fingerprint)
+}
 
-	modulePath, err := filepath.Abs(modulePath)
+// readOutputs returns the Terraform outputs of an applied module,
+// and publishes them to Consul under key when the command defines an outputs path.
+func (s *Server) readOutputs(cmd *command.Command, terraformDriver, moduleDir string, opts terraform.Options, key string) json.RawMessage {
+	outputs, err := terraform.TerraformOutputs(terraformDriver, moduleDir, opts)
 	if err != nil {
-		log.Fatal("Failed to get absolute path: %w", err)
+		log.Error("Failed to collect outputs for %s: %v", key, err)
+		return nil
 	}
 
-	alertParameters := map[string]string{
-		"fingerprint": fingerprint,
-		"module":      modulePath,
-		"terraform_driver": terraformDriver,
-		"terraform_scheduling": terraformScheduling,
+	if cmd.OutputsPath == "" {
+		return outputs
 	}
 
-	data, err := json.MarshalIndent(alertParameters, "", "    ")
-	if err != nil {
-		return fmt.Errorf("Error marshaling fingerprint data: %w", err)
+	if !config.ConsulStorageEnabled {
+		log.Warn("Outputs path %s is set but Consul is not configured. Skipping outputs publication..", cmd.OutputsPath)
+		return outputs
 	}
 
-	switch {
-	case config.ConsulStorageEnabled:
-		log.Info("Using Consul as storage backend for alert: %s", alertName)
-		kvPath := fmt.Sprintf("%s/%s", consulExecutorDir, alertName)
-		err = consul.ConsulStorePut(kvPath, string(data))
-		if err != nil {
-			return fmt.Errorf("Failed to register fingerprint on Consul: %w", err)
-		}
-	default:
-		log.Info("Using defaut storage backend for alert: %s", alertName)
-		filePath := fmt.Sprintf("%s/%s.json", executorDir, fingerprint)
-		err = os.WriteFile(filePath, data, 0644)
-		if err != nil {
-			return fmt.Errorf("Error writing fingerprint data to file: %w", err)
-		}
+	kvPath := fmt.Sprintf("%s/%s", strings.TrimSuffix(cmd.OutputsPath, "/"), key)
+	err = consul.ConsulStorePut(kvPath, string(outputs))
+	if err != nil {
+		log.Error("Failed to publish outputs to Consul: %v", err)
 	}
 
-	return nil
+	return outputs
 }
 
 // CanRun returns true if the Command is allowed to run based on its fingerprint and settings
@@ -613,6 +1240,14 @@ func (s *Server) CanRun(cmd *command.Command, alert *template.Alert) (bool, CmdR
 		return false, CmdRunNoLabelMatch
 	}
 
+	if cmd.Source != "" && !terraform.IsReady(terraform.TaskSource(cmd.Task, cmd.Source)) {
+		return false, CmdRunNotReady
+	}
+
+	if s.coolingDown(cmd, alert) {
+		return false, CmdRunCooldown
+	}
+
 	if cmd.Max <= 0 {
 		return true, CmdRunNoMax
 	}
@@ -655,15 +1290,108 @@ func (s *Server) handleRelease(w http.ResponseWriter, req *http.Request) {
 	}
 
 	log.Info("Processing release for alert: %s", alertData.AlertName)
-	if err := lifecycle.HandleSawtoothScheduling(s.initConfig, alertData.AlertName); err != nil {
+	released, _ := lifecycle.ReadAlert(alertData.AlertName)
+	if released != nil {
+		// The release is queued behind the run under way for the alert
+		ticket := s.runQueue.Enqueue(lifecycle.LifecycleKey(released.Task, released.Fingerprint))
+		ticket.Wait()
+		defer ticket.Done()
+		released, _ = lifecycle.ReadAlert(alertData.AlertName)
+	}
+	if err := lifecycle.HandleRelease(s.initConfig, alertData.AlertName); err != nil {
+		if errors.Is(err, terraform.ErrIntegrity) {
+			var taskName string
+			operation := "destroy"
+			if alertRecord, err := lifecycle.ReadAlert(alertData.AlertName); err == nil {
+				taskName = alertRecord.Task
+				if alertRecord.TerraformScheduling == command.SchedulingInverse {
+					operation = "apply"
+				}
+			}
+			s.integrityCounter.WithLabelValues(taskName, operation).Inc()
+		}
 		handleError(w, err)
 		return
 	}
 
+	s.cancelRelease(alertData.AlertName)
+	if released != nil {
+		setState(released.Task, released.AlertName, released.Fingerprint, lifecycle.StateReleased, "released by an operator")
+	}
+
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprint(w, "Release processed successfully for alert: \n", alertData.AlertName)
 }
 
+// handleSources lists the git sources of tasks, and moves a task's source to another ref.
+//
+// GET /api/v1/sources lists the sources and the commit they're checked out at.
+// POST /api/v1/sources/<task> with {"ref": "<ref>"} checks out another ref without restarting.
+// Moving a source requires the source update token of the server as a bearer token, and is disabled without one.
+func (s *Server) handleSources(w http.ResponseWriter, req *http.Request) {
+	taskName := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/v1/sources"), "/")
+
+	switch {
+	case req.Method == http.MethodGet && taskName == "":
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(terraform.GitSources())
+		if err != nil {
+			handleError(w, err)
+		}
+
+	case req.Method == http.MethodPost && taskName != "":
+		log.Info("Source ref update triggered for task %s from remote address: %s", taskName, req.RemoteAddr)
+
+		token := s.initConfig.Server.SourceUpdateToken
+		if token == "" {
+			http.Error(w, "source updates are disabled, set source_update_token in the server block to enable them", http.StatusForbidden)
+			return
+		}
+		given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			log.Warn("Refused source ref update for task %s from remote address %s: invalid token", taskName, req.RemoteAddr)
+			http.Error(w, "invalid source update token", http.StatusUnauthorized)
+			return
+		}
+
+		var refData struct {
+			Ref string `json:"ref"`
+		}
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+		if err := json.Unmarshal(data, &refData); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if refData.Ref == "" {
+			http.Error(w, "ref is required", http.StatusBadRequest)
+			return
+		}
+
+		src, err := terraform.UpdateSourceRef(taskName, refData.Ref)
+		if errors.Is(err, terraform.ErrSourcePinned) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(src)
+		if err != nil {
+			handleError(w, err)
+		}
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 // Start runs a golang http server with the given routes.
 // Returns
 // * a reference to the HTTP server (so that we can gracefully shut it down)
@@ -677,6 +1405,8 @@ func (s *Server) Start() (*http.Server, chan error) {
 	s.registry.MustRegister(s.errCounter)
 	s.registry.MustRegister(s.sigCounter)
 	s.registry.MustRegister(s.skipCounter)
+	s.registry.MustRegister(s.integrityCounter)
+	s.registry.MustRegister(s.flapGauge)
 
 	// Initialize metrics
 	err := s.initMetrics()
@@ -684,12 +1414,29 @@ func (s *Server) Start() (*http.Server, chan error) {
 		panic(err)
 	}
 
+	recoverStates()
+	s.recoverAggregates()
+	s.recoverScales()
+	s.recoverReleases()
+	s.recoverLeases()
+	s.recoverDestroys()
+	s.recoverPending()
+	s.recoverFlaps()
+
 	// We use our own instance of ServeMux instead of DefaultServeMux,
 	// to keep handler registration separate between server instances.
 	mux := http.NewServeMux()
 	srv := &http.Server{Addr: serverPort, Handler: mux}
 	mux.HandleFunc("/", s.handleWebhook)
 	mux.HandleFunc("/release", s.handleRelease)
+	mux.HandleFunc("/api/v1/alerts/", s.handleAlert)
+	mux.HandleFunc("/api/v1/releases", s.handleReleases)
+	mux.HandleFunc("/api/v1/flaps", s.handleFlaps)
+	mux.HandleFunc("/api/v1/states", s.handleStates)
+	mux.HandleFunc("/api/v1/states/", s.handleStates)
+	mux.HandleFunc("/api/v1/flaps/ack", s.handleFlapAck)
+	mux.HandleFunc("/api/v1/sources", s.handleSources)
+	mux.HandleFunc("/api/v1/sources/", s.handleSources)
 	mux.HandleFunc("/_health", handleHealth)
 	mux.Handle("/metrics", promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{
 		// Prometheus can use the same logger we are, when printing errors about serving metrics
@@ -742,7 +1489,18 @@ func NewServer(initConfig *config.InitConfig, config *config.Config) *Server {
 		errCounter:      prometheus.NewCounterVec(errCountOpts, errCountLabels),
 		sigCounter:      prometheus.NewCounterVec(sigCountOpts, sigCountLabels),
 		skipCounter:     prometheus.NewCounterVec(skipCountOpts, skipCountLabels),
+		integrityCounter: prometheus.NewCounterVec(integrityCountOpts, integrityCountLabels),
+		flapGauge:       prometheus.NewGaugeVec(flapGaugeOpts, flapGaugeLabels),
 		commandDetails:	 make(map[string]CommandDetails),
+		aggregateTimers: make(map[string]*time.Timer),
+		scaleTimers:     make(map[string]*time.Timer),
+		releaseTimers:   make(map[string]*time.Timer),
+		leaseTimers:     make(map[string]*time.Timer),
+		destroyTimers:   make(map[string]*time.Timer),
+		pendingTimers:   make(map[string]*time.Timer),
+		flapTimers:      make(map[string]*time.Timer),
+		taskRuns:        make(map[string]*sync.Mutex),
+		runQueue:        runqueue.NewQueue(),
 	}
 
 	return &s
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/cloudputation/iterator/packages/command"
+	"github.com/cloudputation/iterator/packages/lifecycle"
+	log "github.com/cloudputation/iterator/packages/logger"
+)
+
+// setState moves the lifecycle of an alert for a task to a new state.
+// It returns false if the state machine refused the transition.
+func setState(taskName, alertName, fingerprint string, state lifecycle.State, reason string) bool {
+	if taskName == "" || fingerprint == "" {
+		return true
+	}
+
+	lc, err := lifecycle.Transition(taskName, alertName, fingerprint, state, reason)
+	if err != nil {
+		log.Warn("Lifecycle of alert %s for task %s: %v", alertName, taskName, err)
+		return false
+	}
+
+	log.Debug("Alert %s is %s for task %s: %s", alertName, lc.State, taskName, reason)
+	return true
+}
+
+// runStates returns the states a command moves an alert through when it fires:
+// the run under way, then the state the alert is in once the run succeeded.
+func runStates(cmd *command.Command) (lifecycle.State, lifecycle.State) {
+	if cmd.IsInverse() {
+		return lifecycle.StateDestroying, lifecycle.StateDestroyed
+	}
+	return lifecycle.StateApplying, lifecycle.StateApplied
+}
+
+// ranFor returns true if a command already ran, or is running, for an alert.
+// Alerts recorded before their lifecycle was tracked are known from their record.
+func ranFor(cmd *command.Command, alertName, fingerprint string) bool {
+	running, done := runStates(cmd)
+	switch lifecycle.CurrentState(cmd.Task, fingerprint) {
+	case running, done:
+		return true
+	case "":
+		alertRecord, err := lifecycle.ReadAlert(lifecycle.AlertKey(alertName, fingerprint))
+		return err == nil && alertRecord.Fingerprint == fingerprint
+	}
+	return false
+}
+
+// recoverStates fails the runs that were under way when Iterator stopped,
+// so that the alerts they ran for can move on.
+func recoverStates() {
+	lifecycles, err := lifecycle.ListLifecycles()
+	if err != nil {
+		log.Error("Failed to list alert lifecycles: %v", err)
+		return
+	}
+
+	for _, lc := range lifecycles {
+		if lc.State.InProgress() {
+			log.Warn("Alert %s was %s for task %s when Iterator stopped", lc.AlertName, lc.State, lc.Task)
+			setState(lc.Task, lc.AlertName, lc.Fingerprint, lifecycle.StateFailed, "interrupted by a restart")
+		}
+	}
+}
+
+// handleStates responds with the lifecycles of all alerts, or the one whose key is in the path.
+func (s *Server) handleStates(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var response interface{}
+	key := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/v1/states"), "/")
+	if key != "" {
+		lc, err := lifecycle.ReadLifecycle(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		response = lc
+	} else {
+		lifecycles, err := lifecycle.ListLifecycles()
+		if err != nil {
+			handleError(w, err)
+			return
+		}
+
+		list := make([]*lifecycle.Lifecycle, 0, len(lifecycles))
+		for _, lc := range lifecycles {
+			list = append(list, lc)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return lifecycle.LifecycleKey(list[i].Task, list[i].Fingerprint) < lifecycle.LifecycleKey(list[j].Task, list[j].Fingerprint)
+		})
+		response = list
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		handleError(w, err)
+	}
+}
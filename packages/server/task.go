@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/cloudputation/iterator/packages/command"
+	"github.com/cloudputation/iterator/packages/terraform"
+)
+
+// Task level commands, like aggregate and scale commands, run for a task as a whole instead of for a single alert.
+
+// taskRunLock returns the lock serializing the runs of a task level command,
+// or of a target of an escalating command.
+func (s *Server) taskRunLock(taskName string) *sync.Mutex {
+	s.taskRunsMutex.Lock()
+	defer s.taskRunsMutex.Unlock()
+
+	runLock, ok := s.taskRuns[taskName]
+	if !ok {
+		runLock = &sync.Mutex{}
+		s.taskRuns[taskName] = runLock
+	}
+	return runLock
+}
+
+// applyTask applies the module of a task level command with the given options,
+// and returns the absolute path of the module.
+// The path is also returned along with the error of a failed apply, which may have created resources.
+func (s *Server) applyTask(cmd *command.Command, opts terraform.Options) (string, error) {
+	if cmd.Source == "" {
+		return "", fmt.Errorf("Command %s of task %s requires a static module source", cmd, cmd.Task)
+	}
+
+	// The module is resolved once, in case its git source moves to another ref during the run
+	source := terraform.TaskSource(cmd.Task, cmd.Source)
+	err := terraform.EnsureInit(cmd.Cmd, source)
+	if err != nil {
+		return "", fmt.Errorf("Failed to initialize Terraform module %s: %w", source, err)
+	}
+	release := terraform.AcquireModule(source)
+	defer release()
+
+	err = terraform.VerifyModule(source, opts.Checksum)
+	if err != nil {
+		s.integrityCounter.WithLabelValues(cmd.Task, "apply").Inc()
+		return "", err
+	}
+
+	err = terraform.PrepareModule(cmd.Cmd, source, opts)
+	if err != nil {
+		return "", fmt.Errorf("Failed to prepare Terraform module %s: %w", source, err)
+	}
+
+	modulePath, err := filepath.Abs(source)
+	if err != nil {
+		return "", err
+	}
+
+	err = terraform.RunTerraformWithOptions(cmd.Cmd, source, "apply", opts)
+	return modulePath, err
+}
+
+// taskOptions renders the Terraform options of a task level command,
+// with the value of the task's state passed in the given input variable.
+// Expressions can't refer to an alert, as the command doesn't run for a single one.
+func taskOptions(cmd *command.Command, variable string, value json.RawMessage, runID string) (terraform.Options, error) {
+	opts, err := terraform.NewOptions(terraform.Expressions{
+		Targets:       cmd.Targets,
+		Replace:       cmd.Replace,
+		RefreshOnly:   cmd.RefreshOnly,
+		BackendConfig: cmd.BackendConfig,
+		Variables:     cmd.Variables,
+		Workspace:     cmd.Workspace,
+	}, nil)
+	if err != nil {
+		return opts, fmt.Errorf("Failed to render Terraform options of task %s: %w", cmd.Task, err)
+	}
+
+	if opts.Variables == nil {
+		opts.Variables = make(map[string]json.RawMessage)
+	}
+	opts.Variables[variable] = value
+
+	opts.VarFile, err = terraform.VarFilePath(cmd.Task, runID)
+	if err != nil {
+		return opts, err
+	}
+	opts.Checksum = cmd.SourceChecksum
+
+	err = opts.IsolateBackend(cmd.Task, runID)
+	return opts, err
+}
@@ -3,14 +3,42 @@ package storage
 import (
   "fmt"
   "os"
+  "path/filepath"
+  "strings"
 
   "github.com/cloudputation/iterator/packages/config"
+  "github.com/cloudputation/iterator/packages/consul"
   log "github.com/cloudputation/iterator/packages/logger"
 )
 
+const AlertsNamespace = "process/alerts"
+
+// AggregatesNamespace holds the records of aggregate mode tasks
+const AggregatesNamespace = "process/aggregates"
+
+// ScalesNamespace holds the counters of scale scheduling tasks
+const ScalesNamespace = "process/scales"
+
+// EscalationsNamespace holds the escalation state of the targets of escalating tasks
+const EscalationsNamespace = "process/escalations"
+
+// PendingNamespace holds the firing alerts parked until the fire delay of their task elapses
+const PendingNamespace = "process/pending"
+
+// FlapsNamespace holds the fire and resolve transitions of the alerts of tasks detecting flapping
+const FlapsNamespace = "process/flaps"
+
+// CooldownsNamespace holds the cooldowns started by the applies and destroys of tasks
+const CooldownsNamespace = "process/cooldowns"
+
+// StatesNamespace holds the lifecycle state of the alerts of tasks
+const StatesNamespace = "process/states"
+
+var dataDir = "./data"
+
 func InitStorage(cfg *config.InitConfig) {
-  dataDir := cfg.Server.DataDir
-  executorDir := fmt.Sprintf("%s/process/alerts", dataDir)
+  dataDir = cfg.Server.DataDir
+  executorDir := fmt.Sprintf("%s/%s", dataDir, AlertsNamespace)
 
   dataDirectories := []string{dataDir, executorDir}
 
@@ -29,3 +57,87 @@ func createDirectory(path string) error {
   log.Info("Directory created: %s", path)
   return nil
 }
+
+// StoreGet returns the data stored under key in the given namespace.
+// Consul is used when it is enabled, the data directory otherwise.
+func StoreGet(namespace, key string) ([]byte, error) {
+  if config.ConsulStorageEnabled {
+    return consul.ConsulStoreGet(consulPath(namespace, key))
+  }
+
+  data, err := os.ReadFile(filePath(namespace, key))
+  if err != nil {
+    return nil, fmt.Errorf("Failed to read key: %s, error: %w", key, err)
+  }
+
+  return data, nil
+}
+
+// StorePut writes data under key in the given namespace.
+func StorePut(namespace, key string, data []byte) error {
+  if config.ConsulStorageEnabled {
+    return consul.ConsulStorePut(consulPath(namespace, key), string(data))
+  }
+
+  path := filePath(namespace, key)
+  if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+    return fmt.Errorf("Failed to create directory for key: %s, error: %w", key, err)
+  }
+  if err := os.WriteFile(path, data, 0644); err != nil {
+    return fmt.Errorf("Failed to write key: %s, error: %w", key, err)
+  }
+
+  return nil
+}
+
+// StoreDelete removes key from the given namespace.
+func StoreDelete(namespace, key string) error {
+  if config.ConsulStorageEnabled {
+    return consul.ConsulStoreDelete(consulPath(namespace, key))
+  }
+
+  err := os.Remove(filePath(namespace, key))
+  if err != nil && !os.IsNotExist(err) {
+    return fmt.Errorf("Failed to delete key: %s, error: %w", key, err)
+  }
+
+  return nil
+}
+
+// StoreList returns the keys stored in the given namespace.
+func StoreList(namespace string) ([]string, error) {
+  if config.ConsulStorageEnabled {
+    return consul.ConsulStoreListKeys(consulPath(namespace, ""), false)
+  }
+
+  entries, err := os.ReadDir(filepath.Join(dataDir, namespace))
+  if err != nil {
+    if os.IsNotExist(err) {
+      return nil, nil
+    }
+    return nil, fmt.Errorf("Failed to list keys at path: %s, error: %w", namespace, err)
+  }
+
+  var keys []string
+  for _, entry := range entries {
+    if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+      continue
+    }
+    keys = append(keys, strings.TrimSuffix(entry.Name(), ".json"))
+  }
+
+  return keys, nil
+}
+
+// DataDir returns the configured data directory.
+func DataDir() string {
+  return dataDir
+}
+
+func consulPath(namespace, key string) string {
+  return fmt.Sprintf("%s/%s/%s", config.ConsulFactoryDataDir, namespace, key)
+}
+
+func filePath(namespace, key string) string {
+  return filepath.Join(dataDir, namespace, fmt.Sprintf("%s.json", key))
+}
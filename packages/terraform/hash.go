@@ -0,0 +1,124 @@
+package terraform
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "io"
+  "io/fs"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+)
+
+const checksumPrefix = "sha256:"
+
+// ErrIntegrity is returned when a module doesn't match its pinned checksum
+var ErrIntegrity = errors.New("module integrity violation")
+
+// hashExcludedDirs are directories written by Terraform itself, which are not part of a module's source
+var hashExcludedDirs = map[string]bool{
+  ".terraform":       true,
+  ".terragrunt-cache": true,
+  ".git":             true,
+}
+
+// hashExcludedFiles are files written by Terraform itself, which are not part of a module's source.
+// The dependency lock file is part of it, as it pins the providers the module runs.
+var hashExcludedFiles = map[string]bool{
+  // Checkouts of git sources are worktrees, pointing at their repository through a .git file
+  ".git":                         true,
+  ".terraform.tfstate.lock.info": true,
+  "terraform.tfstate":            true,
+  "terraform.tfstate.backup":     true,
+}
+
+// HashModule returns a deterministic hash of a module's source tree.
+// Every regular file path and content is included, except for Terraform's own working files,
+// but including the dependency lock file.
+func HashModule(moduleDir string) (string, error) {
+  var files []string
+
+  err := filepath.WalkDir(moduleDir, func(path string, d fs.DirEntry, err error) error {
+    if err != nil {
+      return err
+    }
+    if d.IsDir() {
+      if path != moduleDir && hashExcludedDirs[d.Name()] {
+        return filepath.SkipDir
+      }
+      return nil
+    }
+    if hashExcludedFiles[d.Name()] || strings.HasSuffix(d.Name(), ".tfstate") {
+      return nil
+    }
+    if !d.Type().IsRegular() {
+      // Symlinked files are followed, anything else is not module source
+      info, err := os.Stat(path)
+      if err != nil || !info.Mode().IsRegular() {
+        return nil
+      }
+    }
+    files = append(files, path)
+    return nil
+  })
+  if err != nil {
+    return "", fmt.Errorf("Failed to walk module %s: %v", moduleDir, err)
+  }
+
+  sort.Strings(files)
+
+  h := sha256.New()
+  for _, path := range files {
+    rel, err := filepath.Rel(moduleDir, path)
+    if err != nil {
+      return "", err
+    }
+
+    f, err := os.Open(path)
+    if err != nil {
+      return "", fmt.Errorf("Failed to read module file %s: %v", path, err)
+    }
+    fileHash := sha256.New()
+    _, err = io.Copy(fileHash, f)
+    f.Close()
+    if err != nil {
+      return "", fmt.Errorf("Failed to read module file %s: %v", path, err)
+    }
+
+    fmt.Fprintf(h, "%s\x00%x\n", filepath.ToSlash(rel), fileHash.Sum(nil))
+  }
+
+  return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ModuleChecksum returns the checksum of a module, in the format expected by source_checksum
+func ModuleChecksum(moduleDir string) (string, error) {
+  hash, err := HashModule(moduleDir)
+  if err != nil {
+    return "", err
+  }
+  return checksumPrefix + hash, nil
+}
+
+// VerifyModule checks a module against a pinned checksum.
+// The returned error wraps ErrIntegrity when the module changed.
+func VerifyModule(moduleDir, checksum string) error {
+  if checksum == "" {
+    return nil
+  }
+
+  hash, err := HashModule(moduleDir)
+  if err != nil {
+    return fmt.Errorf("%w: %v", ErrIntegrity, err)
+  }
+
+  want := strings.ToLower(strings.TrimPrefix(checksum, checksumPrefix))
+  if hash != want {
+    return fmt.Errorf("%w: module %s has checksum %s%s, expected %s%s", ErrIntegrity, moduleDir, checksumPrefix, hash, checksumPrefix, want)
+  }
+
+  return nil
+}
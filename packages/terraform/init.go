@@ -0,0 +1,356 @@
+package terraform
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/cloudputation/iterator/packages/config"
+  log "github.com/cloudputation/iterator/packages/logger"
+)
+
+// How often module sources are checked for changes
+const moduleWatchInterval = time.Minute
+
+// moduleState tracks the initialization of a module directory
+type moduleState struct {
+  ready bool
+  hash  string
+}
+
+// moduleRuns tracks the runs in flight on a module directory, which is not re-initialized under them
+type moduleRuns struct {
+  inFlight     int
+  initializing bool
+}
+
+// moduleConfig is how a module directory is initialized
+type moduleConfig struct {
+  driver   string
+  initArgs []string
+}
+
+var (
+  // Plugin cache shared by every module, set by InitTerraform
+  pluginCacheDir string
+  // Terraform's plugin cache is not safe for concurrent use, so inits are serialized
+  initMutex sync.Mutex
+  modules      = make(map[string]*moduleState)
+  modulesMutex sync.RWMutex
+  // Init configuration of each managed module directory
+  moduleConfigs = make(map[string]moduleConfig)
+  // Init configuration of each task, for the module directories its templated source resolves to at runtime
+  taskModuleConfigs = make(map[string]moduleConfig)
+  // Runs in flight on each module directory, guarded by runsMutex and signalled on runsCond
+  runsByModule = make(map[string]*moduleRuns)
+  runsMutex    sync.Mutex
+  runsCond     = sync.NewCond(&runsMutex)
+)
+
+// Env returns the environment variables every Terraform process runs with
+func Env() []string {
+  if pluginCacheDir == "" {
+    return nil
+  }
+  return []string{"TF_PLUGIN_CACHE_DIR=" + pluginCacheDir}
+}
+
+// InitTerraform initializes the module of every task and waits for the results.
+// Tasks whose module failed to initialize are not ready, and are retried by the module watcher.
+func InitTerraform(cfg *config.InitConfig) error {
+  log.Info("Initializing Terraform..")
+
+  pluginCacheDir = filepath.Join(cfg.Server.DataDir, "terraform", "plugin-cache")
+  workingCopiesDir = filepath.Join(cfg.Server.DataDir, "terraform", "runs")
+  backendDataDir = filepath.Join(cfg.Server.DataDir, "terraform", "backends")
+  varFilesDir = filepath.Join(cfg.Server.DataDir, "terraform", "vars")
+  if err := os.MkdirAll(pluginCacheDir, 0755); err != nil {
+    return fmt.Errorf("Failed to create Terraform plugin cache directory %s: %v", pluginCacheDir, err)
+  }
+
+  var wg sync.WaitGroup
+  var mu sync.Mutex
+  var failed []string
+
+  for _, task := range cfg.Tasks {
+    terraformDriver := taskDriver(cfg, task)
+    opts, err := NewOptions(TaskExpressions(task), nil)
+    if err != nil {
+      log.Debug("Options of task %s depend on alert data, initializing without them: %v", task.Name, err)
+      opts = Options{}
+    }
+    initArgs := opts.Args("init")
+    if len(task.BackendConfig) > 0 && len(opts.BackendConfig) == 0 {
+      // The backend is configured per alert
+      initArgs = []string{"-backend=false"}
+    }
+
+    modulesMutex.Lock()
+    taskModuleConfigs[task.Name] = moduleConfig{driver: terraformDriver, initArgs: initArgs}
+    modulesMutex.Unlock()
+
+    for _, moduleDir := range TaskModules(task) {
+      registerModule(moduleDir, terraformDriver, initArgs)
+
+      wg.Add(1)
+      go func(t *config.Task, moduleDir string, opts Options) {
+        defer wg.Done()
+        err := EnsureInit(terraformDriver, moduleDir)
+        if err != nil {
+          log.Error("Task %s is not ready: %v", t.Name, err)
+          mu.Lock()
+          failed = append(failed, t.Name)
+          mu.Unlock()
+          return
+        }
+        log.Info("Task %s is ready with module %s", t.Name, moduleDir)
+
+        if len(t.BackendConfig) > 0 && len(opts.BackendConfig) == 0 {
+          return
+        }
+        if err := RunTerraformWithOptions(terraformDriver, moduleDir, "plan", opts); err != nil {
+          log.Warn("Failed to plan Terraform module %s: %v", moduleDir, err)
+        }
+      }(task, moduleDir, opts)
+    }
+  }
+
+  wg.Wait()
+  go watchModules()
+
+  if len(failed) > 0 {
+    return fmt.Errorf("Failed to initialize Terraform for tasks: %s", strings.Join(failed, ", "))
+  }
+
+  return nil
+}
+
+// EnsureInit initializes a module directory unless it was already initialized from the same source.
+// A re-initialization waits for the runs in flight on the module directory to finish.
+func EnsureInit(terraformDriver, moduleDir string) error {
+  return ensureInit(terraformDriver, moduleDir, true)
+}
+
+// ensureInit initializes a module directory unless it was already initialized from the same source.
+// Unless wait is set, a module directory with runs in flight is left as it is, to be re-initialized later.
+func ensureInit(terraformDriver, moduleDir string, wait bool) error {
+  hash, err := HashModule(moduleDir)
+  if err != nil {
+    setModuleState(moduleDir, false, "")
+    return err
+  }
+
+  modulesMutex.RLock()
+  state, ok := modules[moduleDir]
+  upToDate := ok && state.ready && state.hash == hash
+  modulesMutex.RUnlock()
+  if upToDate {
+    return nil
+  }
+
+  if !lockInit(moduleDir, wait) {
+    log.Info("Module %s has runs in flight, re-initializing it once they are over", moduleDir)
+    return nil
+  }
+  defer unlockInit(moduleDir)
+
+  if ok && state.ready && state.hash != hash {
+    log.Info("Module source changed, re-initializing: %s", moduleDir)
+  }
+
+  modulesMutex.RLock()
+  initArgs := moduleConfigs[moduleDir].initArgs
+  modulesMutex.RUnlock()
+
+  err = InitModule(terraformDriver, moduleDir, initArgs...)
+  if err != nil {
+    setModuleState(moduleDir, false, "")
+    return err
+  }
+
+  // Init writes the dependency lock file when the module doesn't have one yet
+  hash, err = HashModule(moduleDir)
+  if err != nil {
+    setModuleState(moduleDir, false, "")
+    return err
+  }
+
+  setModuleState(moduleDir, true, hash)
+  return nil
+}
+
+// InitModule runs init on a module directory, holding the init lock
+func InitModule(terraformDriver, moduleDir string, initArgs ...string) error {
+  return initModule(terraformDriver, moduleDir, initArgs, nil)
+}
+
+func initModule(terraformDriver, moduleDir string, initArgs, env []string) error {
+  initMutex.Lock()
+  defer initMutex.Unlock()
+
+  return runTerraformArgs(terraformDriver, moduleDir, "init", append([]string{"-input=false"}, initArgs...), env)
+}
+
+// AcquireModule marks a run of a module directory as in flight until the returned function is called.
+// It waits for a re-initialization of the module directory under way, and holds back the next one until then.
+func AcquireModule(moduleDir string) func() {
+  if moduleDir == "" {
+    return func() {}
+  }
+  moduleDir = runsKey(moduleDir)
+
+  runsMutex.Lock()
+  for runsOf(moduleDir).initializing {
+    runsCond.Wait()
+  }
+  runsOf(moduleDir).inFlight++
+  runsMutex.Unlock()
+
+  var once sync.Once
+  return func() {
+    once.Do(func() {
+      runsMutex.Lock()
+      runsOf(moduleDir).inFlight--
+      forgetRuns(moduleDir)
+      runsMutex.Unlock()
+      runsCond.Broadcast()
+    })
+  }
+}
+
+// lockInit waits for the runs in flight on a module directory to finish, and holds back new ones until unlockInit.
+// Unless wait is set, it returns false right away when runs are in flight.
+func lockInit(moduleDir string, wait bool) bool {
+  moduleDir = runsKey(moduleDir)
+
+  runsMutex.Lock()
+  defer runsMutex.Unlock()
+
+  for runsOf(moduleDir).initializing || runsOf(moduleDir).inFlight > 0 {
+    if !wait {
+      forgetRuns(moduleDir)
+      return false
+    }
+    runsCond.Wait()
+  }
+  runsOf(moduleDir).initializing = true
+  return true
+}
+
+// unlockInit lets the runs held back by lockInit start.
+func unlockInit(moduleDir string) {
+  moduleDir = runsKey(moduleDir)
+
+  runsMutex.Lock()
+  runsOf(moduleDir).initializing = false
+  forgetRuns(moduleDir)
+  runsMutex.Unlock()
+  runsCond.Broadcast()
+}
+
+// runsKey returns the key the runs of a module directory are tracked under,
+// its absolute path, as runs refer to a module directory both ways.
+func runsKey(moduleDir string) string {
+  if abs, err := filepath.Abs(moduleDir); err == nil {
+    return abs
+  }
+  return filepath.Clean(moduleDir)
+}
+
+// runsOf returns the runs of a module directory. It must be called with runsMutex held.
+func runsOf(moduleDir string) *moduleRuns {
+  runs, ok := runsByModule[moduleDir]
+  if !ok {
+    runs = &moduleRuns{}
+    runsByModule[moduleDir] = runs
+  }
+  return runs
+}
+
+// forgetRuns drops the runs of a module directory once it is idle. It must be called with runsMutex held.
+func forgetRuns(moduleDir string) {
+  if runs, ok := runsByModule[moduleDir]; ok && runs.inFlight == 0 && !runs.initializing {
+    delete(runsByModule, moduleDir)
+  }
+}
+
+// IsReady returns true once a module directory was successfully initialized
+func IsReady(moduleDir string) bool {
+  modulesMutex.RLock()
+  defer modulesMutex.RUnlock()
+  state, ok := modules[moduleDir]
+  return ok && state.ready
+}
+
+func setModuleState(moduleDir string, ready bool, hash string) {
+  modulesMutex.Lock()
+  defer modulesMutex.Unlock()
+  modules[moduleDir] = &moduleState{ready: ready, hash: hash}
+}
+
+func registerModule(moduleDir, terraformDriver string, initArgs []string) {
+  modulesMutex.Lock()
+  defer modulesMutex.Unlock()
+  moduleConfigs[moduleDir] = moduleConfig{driver: terraformDriver, initArgs: initArgs}
+}
+
+// registerTaskModule registers a module directory of a task the first time its templated source resolves to it,
+// so that a directory created after startup is initialized like those found at startup.
+func registerTaskModule(taskName, moduleDir string) {
+  modulesMutex.Lock()
+  defer modulesMutex.Unlock()
+
+  if _, ok := moduleConfigs[moduleDir]; ok {
+    return
+  }
+  moduleCfg, ok := taskModuleConfigs[taskName]
+  if !ok {
+    return
+  }
+  moduleConfigs[moduleDir] = moduleCfg
+  log.Info("Managing module %s resolved for task %s", moduleDir, taskName)
+}
+
+// watchModules periodically re-initializes modules whose source changed or whose init failed
+func watchModules() {
+  ticker := time.NewTicker(moduleWatchInterval)
+  defer ticker.Stop()
+
+  for range ticker.C {
+    modulesMutex.RLock()
+    drivers := make(map[string]string, len(moduleConfigs))
+    for moduleDir, moduleCfg := range moduleConfigs {
+      drivers[moduleDir] = moduleCfg.driver
+    }
+    modulesMutex.RUnlock()
+
+    for moduleDir, terraformDriver := range drivers {
+      // Modules with runs in flight are re-initialized on a later tick, or by the next run
+      if err := ensureInit(terraformDriver, moduleDir, false); err != nil {
+        log.Error("Failed to initialize Terraform module %s: %v", moduleDir, err)
+      }
+    }
+  }
+}
+
+// TaskExpressions returns the option expressions of a task
+func TaskExpressions(task *config.Task) Expressions {
+  return Expressions{
+    Targets:       task.TerraformTargets(),
+    Replace:       task.TerraformReplace(),
+    RefreshOnly:   task.TerraformRefreshOnly(),
+    BackendConfig: task.BackendConfig,
+    Variables:     task.Variables,
+    Workspace:     task.Workspace,
+  }
+}
+
+func taskDriver(cfg *config.InitConfig, task *config.Task) string {
+  if task.TerraformDriver != "" {
+    return task.TerraformDriver
+  }
+  return cfg.Server.TerraformDriver
+}
@@ -0,0 +1,53 @@
+package terraform
+
+import (
+  "testing"
+  "time"
+)
+
+func TestModuleNotReinitializedUnderRun(t *testing.T) {
+  moduleDir := t.TempDir()
+
+  release := AcquireModule(moduleDir)
+  if lockInit(moduleDir, false) {
+    t.Fatal("module was locked for init while a run is in flight")
+  }
+
+  initialized := make(chan struct{})
+  go func() {
+    lockInit(moduleDir, true)
+    close(initialized)
+  }()
+
+  select {
+  case <-initialized:
+    t.Fatal("init didn't wait for the run in flight")
+  case <-time.After(50 * time.Millisecond):
+  }
+
+  release()
+  select {
+  case <-initialized:
+  case <-time.After(time.Second):
+    t.Fatal("init didn't start once the run was over")
+  }
+
+  acquired := make(chan struct{})
+  go func() {
+    AcquireModule(moduleDir)()
+    close(acquired)
+  }()
+
+  select {
+  case <-acquired:
+    t.Fatal("run started while the module is being initialized")
+  case <-time.After(50 * time.Millisecond):
+  }
+
+  unlockInit(moduleDir)
+  select {
+  case <-acquired:
+  case <-time.After(time.Second):
+    t.Fatal("run didn't start once the init was over")
+  }
+}
@@ -0,0 +1,365 @@
+package terraform
+
+import (
+  "encoding/json"
+  "fmt"
+  "os"
+  "path/filepath"
+  "regexp"
+  "sort"
+  "strings"
+
+  "github.com/prometheus/alertmanager/template"
+  "github.com/zclconf/go-cty/cty"
+
+  "github.com/cloudputation/iterator/packages/interpolate"
+  log "github.com/cloudputation/iterator/packages/logger"
+)
+
+// Expressions are the HCL expression sources options are rendered from
+type Expressions struct {
+  Targets       string
+  Replace       string
+  RefreshOnly   string
+  BackendConfig map[string]string
+  Variables     map[string]string
+  Workspace     string
+}
+
+// WorkspacePerFingerprint names the workspace of a run after the alert fingerprint
+const WorkspacePerFingerprint = "per_fingerprint"
+
+// Options are the per run flags passed to the Terraform driver
+type Options struct {
+  Targets       []string          `json:"targets,omitempty"`
+  Replace       []string          `json:"replace,omitempty"`
+  RefreshOnly   bool              `json:"refresh_only,omitempty"`
+  BackendConfig map[string]string `json:"backend_config,omitempty"`
+  Workspace     string            `json:"workspace,omitempty"`
+  // Module input variables as JSON values, and the tfvars file they're written to
+  Variables     map[string]json.RawMessage `json:"variables,omitempty"`
+  VarFile       string            `json:"var_file,omitempty"`
+  // Terraform data directory of a working copy, or of a run with a backend configuration
+  DataDir       string            `json:"data_dir,omitempty"`
+  // Checksum the module must match before it is run
+  Checksum      string            `json:"source_checksum,omitempty"`
+}
+
+// NewOptions evaluates option expressions against an alert.
+// Expressions referring to the alert fail to evaluate when no alert is given.
+func NewOptions(exprs Expressions, alert *template.Alert) (Options, error) {
+  return newOptions(exprs, alert, "")
+}
+
+// NewElementOptions evaluates option expressions against an alert and an element of a fan-out,
+// exposed to the expressions as `each.key` and `each.value`.
+// Each element runs in its own workspace, suffixed with the element when the task doesn't set one.
+func NewElementOptions(exprs Expressions, alert *template.Alert, element string) (Options, error) {
+  opts, err := newOptions(exprs, alert, element)
+  if err != nil {
+    return opts, err
+  }
+
+  if opts.Workspace == "" && alert != nil {
+    opts.Workspace = ElementID(alert.Fingerprint, element)
+  }
+
+  return opts, nil
+}
+
+// ElementID identifies the run of a fan-out element for an alert fingerprint.
+// It names the element's workspace, working copy and variables file.
+func ElementID(fingerprint, element string) string {
+  return fingerprint + "-" + workspaceUnsafe.ReplaceAllString(element, "_")
+}
+
+// Characters that are not allowed in workspace names and file names
+var workspaceUnsafe = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+func newOptions(exprs Expressions, alert *template.Alert, element string) (Options, error) {
+  var opts Options
+
+  var vars map[string]cty.Value
+  if element != "" {
+    vars = map[string]cty.Value{"each": interpolate.EachValue(element)}
+  }
+  ctx := interpolate.EvalContext(alert, vars)
+
+  if exprs.Targets != "" {
+    val, err := interpolate.ValueWithContext(exprs.Targets, ctx)
+    if err == nil {
+      opts.Targets, err = interpolate.AsStrings(val)
+    }
+    if err != nil {
+      return opts, fmt.Errorf("invalid targets: %w", err)
+    }
+  }
+
+  if exprs.Replace != "" {
+    val, err := interpolate.ValueWithContext(exprs.Replace, ctx)
+    if err == nil {
+      opts.Replace, err = interpolate.AsStrings(val)
+    }
+    if err != nil {
+      return opts, fmt.Errorf("invalid replace: %w", err)
+    }
+  }
+
+  if exprs.RefreshOnly != "" {
+    val, err := interpolate.ValueWithContext(exprs.RefreshOnly, ctx)
+    if err == nil {
+      opts.RefreshOnly, err = interpolate.AsBool(val)
+    }
+    if err != nil {
+      return opts, fmt.Errorf("invalid refresh_only: %w", err)
+    }
+  }
+
+  if len(exprs.BackendConfig) > 0 {
+    opts.BackendConfig = make(map[string]string, len(exprs.BackendConfig))
+    for k, src := range exprs.BackendConfig {
+      val, err := interpolate.ValueWithContext(src, ctx)
+      if err == nil {
+        opts.BackendConfig[k], err = interpolate.AsString(val)
+      }
+      if err != nil {
+        return opts, fmt.Errorf("invalid backend_config %s: %w", k, err)
+      }
+    }
+  }
+
+  if len(exprs.Variables) > 0 {
+    opts.Variables = make(map[string]json.RawMessage, len(exprs.Variables))
+    for name, src := range exprs.Variables {
+      val, err := interpolate.ValueWithContext(src, ctx)
+      if err == nil {
+        opts.Variables[name], err = interpolate.JSON(val)
+      }
+      if err != nil {
+        return opts, fmt.Errorf("invalid variable %s: %w", name, err)
+      }
+    }
+  }
+
+  if exprs.Workspace != "" {
+    val, err := interpolate.ValueWithContext(exprs.Workspace, ctx)
+    if err == nil {
+      opts.Workspace, err = interpolate.AsString(val)
+    }
+    if err != nil {
+      return opts, fmt.Errorf("invalid workspace: %w", err)
+    }
+    if opts.Workspace == WorkspacePerFingerprint {
+      if alert == nil {
+        return opts, fmt.Errorf("invalid workspace: %s requires an alert", WorkspacePerFingerprint)
+      }
+      opts.Workspace = alert.Fingerprint
+      if element != "" {
+        opts.Workspace = ElementID(alert.Fingerprint, element)
+      }
+    }
+  }
+
+  return opts, nil
+}
+
+// Env returns the environment variables of the options.
+// The workspace is pinned through TF_WORKSPACE so that runs sharing a module directory don't switch each other's workspace.
+func (o Options) Env() []string {
+  var env []string
+  if o.Workspace != "" {
+    env = append(env, "TF_WORKSPACE="+o.Workspace)
+  }
+  if o.DataDir != "" {
+    env = append(env, "TF_DATA_DIR="+o.DataDir)
+  }
+  return env
+}
+
+// dataDirEnv returns the Terraform data directory environment of the options
+func (o Options) dataDirEnv() []string {
+  if o.DataDir == "" {
+    return nil
+  }
+  return []string{"TF_DATA_DIR=" + o.DataDir}
+}
+
+// Args returns the flags of the options that apply to a Terraform command
+func (o Options) Args(terraformCommand string) []string {
+  var args []string
+
+  switch terraformCommand {
+  case "init":
+    if len(o.BackendConfig) > 0 {
+      args = append(args, "-reconfigure")
+    }
+    keys := make([]string, 0, len(o.BackendConfig))
+    for k := range o.BackendConfig {
+      keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+      args = append(args, fmt.Sprintf("-backend-config=%s=%s", k, o.BackendConfig[k]))
+    }
+  case "plan", "apply", "destroy":
+    if o.VarFile != "" {
+      args = append(args, "-var-file="+o.VarFile)
+    }
+    for _, target := range o.Targets {
+      args = append(args, "-target="+target)
+    }
+  }
+
+  switch terraformCommand {
+  case "plan", "apply":
+    for _, replace := range o.Replace {
+      args = append(args, "-replace="+replace)
+    }
+    if o.RefreshOnly {
+      args = append(args, "-refresh-only")
+    }
+  }
+
+  return args
+}
+
+// PrepareModule readies a module directory for a run with the given options.
+// Working copies and runs with a backend configuration are (re-)initialized in their own data directory,
+// the workspace is created if it doesn't exist yet, and the variables file is written.
+func PrepareModule(terraformDriver, moduleDir string, opts Options) error {
+  if opts.VarFile != "" {
+    err := writeVarFile(opts.VarFile, opts.Variables)
+    if err != nil {
+      return err
+    }
+  }
+
+  if len(opts.BackendConfig) > 0 || opts.DataDir != "" {
+    err := initModule(terraformDriver, moduleDir, opts.Args("init"), opts.dataDirEnv())
+    if err != nil {
+      return err
+    }
+  }
+
+  if opts.Workspace != "" {
+    err := createWorkspace(terraformDriver, moduleDir, opts)
+    if err != nil {
+      return fmt.Errorf("Failed to create workspace %s: %v", opts.Workspace, err)
+    }
+  }
+
+  return nil
+}
+
+// createWorkspace creates the workspace of a run unless it exists already.
+// The run only relies on TF_WORKSPACE: as `workspace new` also selects the workspace it creates,
+// the workspace selected in the data directory of the module is put back for the other runs sharing it.
+func createWorkspace(terraformDriver, moduleDir string, opts Options) error {
+  initMutex.Lock()
+  defer initMutex.Unlock()
+
+  workspaces, err := terraformStdout(terraformDriver, moduleDir, []string{"workspace", "list"}, opts.dataDirEnv())
+  if err != nil {
+    return err
+  }
+  for _, line := range strings.Split(workspaces, "\n") {
+    if strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "*")) == opts.Workspace {
+      return nil
+    }
+  }
+
+  dataDir := opts.DataDir
+  if dataDir == "" {
+    dataDir = filepath.Join(moduleDir, ".terraform")
+  }
+  environmentFile := filepath.Join(dataDir, "environment")
+  selected, readErr := os.ReadFile(environmentFile)
+
+  // Terraform refuses to create a workspace other than the one TF_WORKSPACE overrides
+  _, err = terraformStdout(terraformDriver, moduleDir, []string{"workspace", "new", opts.Workspace}, opts.Env())
+
+  switch {
+  case readErr == nil:
+    if writeErr := os.WriteFile(environmentFile, selected, 0644); writeErr != nil {
+      log.Error("Failed to restore the workspace selected in %s: %v", dataDir, writeErr)
+    }
+  case os.IsNotExist(readErr):
+    if removeErr := os.Remove(environmentFile); removeErr != nil && !os.IsNotExist(removeErr) {
+      log.Error("Failed to restore the workspace selected in %s: %v", dataDir, removeErr)
+    }
+  }
+
+  if err != nil {
+    if strings.Contains(err.Error(), "already exists") {
+      return nil
+    }
+    return err
+  }
+  log.Info("Created workspace %s for module: %s", opts.Workspace, moduleDir)
+
+  return nil
+}
+
+// DestroyModule destroys the resources of a module that was applied with the given options.
+// The workspace, the variables file and the working copy or data directory of the run are deleted once its resources are destroyed.
+func DestroyModule(terraformDriver, moduleDir string, opts Options) error {
+  release := AcquireModule(moduleDir)
+  defer release()
+
+  err := VerifyModule(moduleDir, opts.Checksum)
+  if err != nil {
+    return err
+  }
+
+  err = PrepareModule(terraformDriver, moduleDir, opts)
+  if err != nil {
+    return err
+  }
+
+  err = RunTerraformWithOptions(terraformDriver, moduleDir, "destroy", opts)
+  if err != nil {
+    return err
+  }
+
+  if opts.Workspace != "" && opts.Workspace != "default" {
+    // The workspace was never selected in the data directory of the module, so it can be deleted as is
+    err = runTerraformArgs(terraformDriver, moduleDir, "workspace", []string{"delete", opts.Workspace}, opts.dataDirEnv())
+    if err != nil {
+      return fmt.Errorf("Failed to delete workspace %s: %v", opts.Workspace, err)
+    }
+  }
+
+  if opts.VarFile != "" {
+    removeVarFile(opts.VarFile)
+  }
+
+  return removeRunDirs(moduleDir, opts)
+}
+
+// RestoreModule re-applies a module whose resources were destroyed by a run with the given options.
+// The variables file of the run is deleted once the resources are restored.
+func RestoreModule(terraformDriver, moduleDir string, opts Options) error {
+  release := AcquireModule(moduleDir)
+  defer release()
+
+  err := VerifyModule(moduleDir, opts.Checksum)
+  if err != nil {
+    return err
+  }
+
+  err = PrepareModule(terraformDriver, moduleDir, opts)
+  if err != nil {
+    return err
+  }
+
+  err = RunTerraformWithOptions(terraformDriver, moduleDir, "apply", opts)
+  if err != nil {
+    return err
+  }
+
+  if opts.VarFile != "" {
+    removeVarFile(opts.VarFile)
+  }
+
+  return nil
+}
@@ -0,0 +1,292 @@
+package terraform
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "net/url"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+
+  "github.com/cloudputation/iterator/packages/config"
+  log "github.com/cloudputation/iterator/packages/logger"
+)
+
+const gitSourcePrefix = "git::"
+
+// ErrSourcePinned is returned when moving the git source of a task whose module is pinned to a checksum
+var ErrSourcePinned = errors.New("source is pinned to a checksum")
+
+// GitSource is a task module fetched from a git repository at a pinned ref
+type GitSource struct {
+  Task   string `json:"task"`
+  Source string `json:"source"`
+  Ref    string `json:"ref"`
+  Commit string `json:"commit"`
+  Module string `json:"module"`
+  repo   string
+  subdir string
+  // Checksum the module of the task is pinned to
+  checksum string
+  // Directory holding the clone of the repository, and a checkout per commit
+  dir    string
+}
+
+var (
+  gitSources      = make(map[string]*GitSource)
+  gitSourcesMutex sync.Mutex
+  // Serializes the ref updates of git sources, which fetch and initialize outside of gitSourcesMutex
+  sourceUpdatesMutex sync.Mutex
+)
+
+// IsGitSource returns true if a task source refers to a git repository
+func IsGitSource(source string) bool {
+  return strings.HasPrefix(source, gitSourcePrefix)
+}
+
+// ResolveSources fetches the git sources of tasks into the data directory,
+// and points the tasks at their local checkout.
+func ResolveSources(cfg *config.InitConfig) error {
+  sourcesDir := filepath.Join(cfg.Server.DataDir, "terraform", "sources")
+
+  for _, task := range cfg.Tasks {
+    if task.SourceTemplate != "" && len(task.AllowedSources) == 0 {
+      return fmt.Errorf("task %s has a templated source but no allowed_sources", task.Name)
+    }
+    if !IsGitSource(task.Source) {
+      continue
+    }
+
+    src, err := parseGitSource(task.Source)
+    if err != nil {
+      return fmt.Errorf("invalid source for task %s: %v", task.Name, err)
+    }
+    src.Task = task.Name
+    src.checksum = task.SourceChecksum
+    src.dir = filepath.Join(sourcesDir, pathSafe(task.Name))
+
+    src.Module, src.Commit, err = src.checkout(src.Ref)
+    if err != nil {
+      return fmt.Errorf("failed to fetch source for task %s: %v", task.Name, err)
+    }
+    log.Info("Task %s source %s checked out at commit %s", task.Name, task.Source, src.Commit)
+
+    gitSourcesMutex.Lock()
+    gitSources[task.Name] = src
+    gitSourcesMutex.Unlock()
+
+    task.Source = src.Module
+  }
+
+  return nil
+}
+
+// TaskSource returns the module directory a task runs.
+// The module of a git source moves to another checkout when its ref is updated,
+// so a run resolves it once, at its start, and keeps running the same checkout.
+func TaskSource(taskName, source string) string {
+  gitSourcesMutex.Lock()
+  defer gitSourcesMutex.Unlock()
+  src, ok := gitSources[taskName]
+  if !ok {
+    return source
+  }
+  return src.Module
+}
+
+// ModuleCommit returns the commit of the git checkout a module directory belongs to
+func ModuleCommit(moduleDir string) string {
+  moduleDir, err := filepath.Abs(moduleDir)
+  if err != nil {
+    return ""
+  }
+
+  gitSourcesMutex.Lock()
+  defer gitSourcesMutex.Unlock()
+  for _, src := range gitSources {
+    rel, err := filepath.Rel(src.checkoutsDir(), moduleDir)
+    if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+      continue
+    }
+    return strings.Split(filepath.ToSlash(rel), "/")[0]
+  }
+
+  return ""
+}
+
+// GitSources returns the git sources of all tasks
+func GitSources() []GitSource {
+  gitSourcesMutex.Lock()
+  defer gitSourcesMutex.Unlock()
+
+  sources := make([]GitSource, 0, len(gitSources))
+  for _, src := range gitSources {
+    sources = append(sources, *src)
+  }
+  sort.Slice(sources, func(i, j int) bool { return sources[i].Task < sources[j].Task })
+
+  return sources
+}
+
+// UpdateSourceRef moves the git source of a task to another ref.
+// The ref is checked out in a directory of its own and initialized, then the task switches over to it at once:
+// runs under way keep running the checkout they started with, and the next runs use the new one.
+func UpdateSourceRef(taskName, ref string) (GitSource, error) {
+  sourceUpdatesMutex.Lock()
+  defer sourceUpdatesMutex.Unlock()
+
+  gitSourcesMutex.Lock()
+  src, ok := gitSources[taskName]
+  var current GitSource
+  if ok {
+    current = *src
+  }
+  gitSourcesMutex.Unlock()
+  if !ok {
+    return GitSource{}, fmt.Errorf("task %s has no git source", taskName)
+  }
+  if current.checksum != "" {
+    return current, fmt.Errorf("%w: task %s pins its module with source_checksum, restart Iterator with the new ref and its checksum instead", ErrSourcePinned, taskName)
+  }
+
+  module, commit, err := current.checkout(ref)
+  if err != nil {
+    return current, err
+  }
+
+  modulesMutex.RLock()
+  moduleCfg, ok := moduleConfigs[current.Module]
+  modulesMutex.RUnlock()
+  if !ok {
+    return current, fmt.Errorf("module %s of task %s is not managed", current.Module, taskName)
+  }
+  registerModule(module, moduleCfg.driver, moduleCfg.initArgs)
+  err = EnsureInit(moduleCfg.driver, module)
+  if err != nil {
+    return current, fmt.Errorf("failed to initialize commit %s of task %s: %v", commit, taskName, err)
+  }
+
+  gitSourcesMutex.Lock()
+  src.Ref = ref
+  src.Commit = commit
+  src.Module = module
+  updated := *src
+  gitSourcesMutex.Unlock()
+  log.Info("Task %s source moved to ref %s at commit %s", taskName, ref, commit)
+
+  return updated, nil
+}
+
+// parseGitSource parses sources of the form git::<repository url>//<subdirectory>?ref=<ref>
+func parseGitSource(source string) (*GitSource, error) {
+  u, err := url.Parse(strings.TrimPrefix(source, gitSourcePrefix))
+  if err != nil {
+    return nil, err
+  }
+
+  src := &GitSource{Source: source, Ref: u.Query().Get("ref")}
+
+  if i := strings.Index(u.Path, "//"); i >= 0 {
+    src.subdir = strings.Trim(u.Path[i+2:], "/")
+    u.Path = u.Path[:i]
+  }
+  if strings.Contains(src.subdir, "..") {
+    return nil, fmt.Errorf("subdirectory %s escapes the repository", src.subdir)
+  }
+
+  u.RawQuery = ""
+  src.repo = u.String()
+
+  return src, nil
+}
+
+// checkout fetches the repository and checks out the commit of a ref in a directory of its own,
+// unless it was checked out already. It returns the module directory within the checkout, and the commit.
+// Checkouts are kept once the source moves on, as the resources applied from them are destroyed from them.
+func (src *GitSource) checkout(ref string) (string, string, error) {
+  repoDir := filepath.Join(src.dir, "repo")
+  if _, err := os.Stat(filepath.Join(repoDir, ".git")); os.IsNotExist(err) {
+    err := os.MkdirAll(src.dir, 0755)
+    if err != nil {
+      return "", "", err
+    }
+    _, err = git("", "clone", "--no-checkout", src.repo, repoDir)
+    if err != nil {
+      return "", "", err
+    }
+  } else {
+    _, err := git(repoDir, "fetch", "--tags", "--force", "origin")
+    if err != nil {
+      return "", "", err
+    }
+  }
+
+  commit, err := src.resolve(ref)
+  if err != nil {
+    return "", "", err
+  }
+
+  checkoutDir := filepath.Join(src.checkoutsDir(), commit)
+  if _, err := os.Stat(checkoutDir); os.IsNotExist(err) {
+    // The commit is checked out aside, and moved in place once complete
+    partialDir := checkoutDir + ".partial"
+    err := os.RemoveAll(partialDir)
+    if err == nil {
+      _, err = git(repoDir, "worktree", "prune")
+    }
+    if err == nil {
+      _, err = git(repoDir, "worktree", "add", "--detach", partialDir, commit)
+    }
+    if err == nil {
+      _, err = git(repoDir, "worktree", "move", partialDir, checkoutDir)
+    }
+    if err != nil {
+      return "", "", err
+    }
+  }
+
+  return filepath.Join(checkoutDir, src.subdir), commit, nil
+}
+
+// checkoutsDir returns the directory holding the checkouts of the source, one per commit
+func (src *GitSource) checkoutsDir() string {
+  return filepath.Join(src.dir, "checkouts")
+}
+
+// resolve returns the commit of a ref, preferring remote branches over local names
+func (src *GitSource) resolve(ref string) (string, error) {
+  if ref == "" {
+    ref = "HEAD"
+  }
+
+  for _, candidate := range []string{"origin/" + ref, ref} {
+    commit, err := git(filepath.Join(src.dir, "repo"), "rev-parse", "--verify", "--quiet", candidate+"^{commit}")
+    if err == nil {
+      return commit, nil
+    }
+  }
+
+  return "", fmt.Errorf("ref %s not found in %s", ref, src.repo)
+}
+
+func git(dir string, args ...string) (string, error) {
+  if dir != "" {
+    args = append([]string{"-C", dir}, args...)
+  }
+  cmd := exec.Command("git", args...)
+
+  var stdout, stderr bytes.Buffer
+  cmd.Stdout = &stdout
+  cmd.Stderr = &stderr
+
+  err := cmd.Run()
+  if err != nil {
+    return "", fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+  }
+
+  return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,88 @@
+package terraform
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "sort"
+
+  "github.com/prometheus/alertmanager/template"
+
+  "github.com/cloudputation/iterator/packages/config"
+  "github.com/cloudputation/iterator/packages/interpolate"
+  log "github.com/cloudputation/iterator/packages/logger"
+)
+
+// ResolveSource renders the templated module source of a task for an alert.
+// The resolved directory must exist and match one of the allowed glob patterns.
+// A directory resolved for the first time is registered with the init configuration of the task.
+func ResolveSource(taskName, sourceTemplate string, allowedSources []string, alert *template.Alert) (string, error) {
+  source, err := interpolate.String(sourceTemplate, alert)
+  if err != nil {
+    return "", fmt.Errorf("invalid source: %w", err)
+  }
+
+  source, err = filepath.Abs(source)
+  if err != nil {
+    return "", fmt.Errorf("invalid source %s: %v", source, err)
+  }
+
+  if !sourceAllowed(source, allowedSources) {
+    return "", fmt.Errorf("source %s is not one of the allowed sources", source)
+  }
+
+  info, err := os.Stat(source)
+  if err != nil || !info.IsDir() {
+    return "", fmt.Errorf("source %s is not a module directory", source)
+  }
+  registerTaskModule(taskName, source)
+
+  return source, nil
+}
+
+// TaskModules returns the module directories a task may run.
+// For templated sources, these are the existing directories matching its allowed sources.
+func TaskModules(task *config.Task) []string {
+  if task.SourceTemplate == "" {
+    return []string{task.Source}
+  }
+
+  seen := make(map[string]bool)
+  var moduleDirs []string
+  for _, pattern := range task.AllowedSources {
+    matches, err := filepath.Glob(pattern)
+    if err != nil {
+      log.Error("Invalid allowed source %s for task %s: %v", pattern, task.Name, err)
+      continue
+    }
+    for _, match := range matches {
+      moduleDir, err := filepath.Abs(match)
+      if err != nil || seen[moduleDir] {
+        continue
+      }
+      if info, err := os.Stat(moduleDir); err != nil || !info.IsDir() {
+        continue
+      }
+      seen[moduleDir] = true
+      moduleDirs = append(moduleDirs, moduleDir)
+    }
+  }
+  sort.Strings(moduleDirs)
+
+  return moduleDirs
+}
+
+// sourceAllowed returns true if a directory matches one of the allowed glob patterns.
+// Wildcards don't match path separators, so a pattern only allows directories at its own depth.
+func sourceAllowed(source string, allowedSources []string) bool {
+  for _, pattern := range allowedSources {
+    pattern, err := filepath.Abs(pattern)
+    if err != nil {
+      continue
+    }
+    if ok, err := filepath.Match(pattern, source); err == nil && ok {
+      return true
+    }
+  }
+  return false
+}
@@ -4,46 +4,35 @@ import (
   "bytes"
   "fmt"
   l "log"
+  "os"
   "os/exec"
+  "strings"
 
-  "github.com/cloudputation/iterator/packages/config"
   log "github.com/cloudputation/iterator/packages/logger"
 )
 
-var terraformInitRoutine = []string{"init", "plan"}
-var terraformDirArg string
-
-func InitTerraform(cfg *config.InitConfig) {
-  log.Info("Initializing Terraform..")
-  terraformDriver := cfg.Server.TerraformDriver
-  for _, task := range cfg.Tasks {
-    go func(t *config.Task) {
-      moduleDir := t.Source
-      for _, command := range terraformInitRoutine {
-        if err := RunTerraform(terraformDriver, moduleDir, command); err != nil {
-          log.Error("Failed to initialize Terraform module %s: %v", moduleDir, err)
-        }
-      }
-    }(task)
-  }
+func RunTerraform(terraformDriver, moduleDir, terraformCommand string) error {
+  return RunTerraformWithOptions(terraformDriver, moduleDir, terraformCommand, Options{})
 }
 
-func RunTerraform(terraformDriver, moduleDir, terraformCommand string) error {
-  switch {
-  case terraformDriver == "terraform":
-    terraformDirArg = "-chdir="
-  case terraformDriver == "terragrunt":
-    terraformDirArg = "-config-dir "
+// RunTerraformWithOptions runs a Terraform command on a module with the given options
+func RunTerraformWithOptions(terraformDriver, moduleDir, terraformCommand string, opts Options) error {
+  var args []string
+  if terraformCommand == "apply" || terraformCommand == "destroy" {
+    args = append(args, "-auto-approve")
   }
+  args = append(args, opts.Args(terraformCommand)...)
 
-  terraformModulePath := fmt.Sprintf("%s%s", terraformDirArg, moduleDir)
-  cmdArgs := []string{terraformModulePath, terraformCommand}
+  return runTerraformArgs(terraformDriver, moduleDir, terraformCommand, args, opts.Env())
+}
 
-  if terraformCommand == "apply" || terraformCommand == "destroy" {
-    cmdArgs = append(cmdArgs, "-auto-approve")
-  }
+// runTerraformArgs runs a Terraform command on a module with the given arguments and additional environment
+func runTerraformArgs(terraformDriver, moduleDir, terraformCommand string, args, env []string) error {
+  terraformModulePath := moduleDirArg(terraformDriver, moduleDir)
+  cmdArgs := append([]string{terraformModulePath, terraformCommand}, args...)
 
   cmd := exec.Command(terraformDriver, cmdArgs...)
+  cmd.Env = append(append(os.Environ(), Env()...), env...)
 
   var stdout, stderr bytes.Buffer
   cmd.Stdout = &stdout
@@ -75,3 +64,46 @@ func RunTerraform(terraformDriver, moduleDir, terraformCommand string) error {
 
   return nil
 }
+
+// TerraformOutputs returns the outputs of a module as produced by `output -json`.
+func TerraformOutputs(terraformDriver, moduleDir string, opts Options) ([]byte, error) {
+  outputs, err := terraformStdout(terraformDriver, moduleDir, []string{"output", "-json"}, opts.Env())
+  if err != nil {
+    return nil, fmt.Errorf("Failed to read Terraform outputs of module: %s: %v", moduleDir, err)
+  }
+
+  return []byte(outputs), nil
+}
+
+// terraformStdout runs a Terraform command on a module and returns its standard output.
+// The returned error carries the standard error of the command.
+func terraformStdout(terraformDriver, moduleDir string, args, env []string) (string, error) {
+  cmd := exec.Command(terraformDriver, append([]string{moduleDirArg(terraformDriver, moduleDir)}, args...)...)
+  cmd.Env = append(append(os.Environ(), Env()...), env...)
+
+  var stdout, stderr bytes.Buffer
+  cmd.Stdout = &stdout
+  cmd.Stderr = &stderr
+
+  err := cmd.Run()
+  if err != nil {
+    return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+  }
+  if stderr.String() != "" {
+    log.Error("Terraform stderr: %s", stderr.String())
+  }
+
+  return stdout.String(), nil
+}
+
+// moduleDirArg returns the argument pointing a Terraform driver at a module directory
+func moduleDirArg(terraformDriver, moduleDir string) string {
+  var terraformDirArg string
+  switch {
+  case terraformDriver == "terraform":
+    terraformDirArg = "-chdir="
+  case terraformDriver == "terragrunt":
+    terraformDirArg = "-config-dir "
+  }
+  return fmt.Sprintf("%s%s", terraformDirArg, moduleDir)
+}
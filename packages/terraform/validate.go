@@ -0,0 +1,333 @@
+package terraform
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+
+  "github.com/hashicorp/hcl/v2"
+  "github.com/hashicorp/hcl/v2/ext/typeexpr"
+  "github.com/hashicorp/hcl/v2/hclparse"
+  "github.com/zclconf/go-cty/cty"
+  "github.com/zclconf/go-cty/cty/convert"
+
+  "github.com/cloudputation/iterator/packages/config"
+  "github.com/cloudputation/iterator/packages/interpolate"
+  log "github.com/cloudputation/iterator/packages/logger"
+)
+
+// Input variables set through the environment of every alert
+var alertEnvVariables = map[string]bool{
+  "ITERATOR_ALERT_STATUS":      true,
+  "ITERATOR_ALERT_START":       true,
+  "ITERATOR_ALERT_END":         true,
+  "ITERATOR_ALERT_URL":         true,
+  "ITERATOR_ALERT_FINGERPRINT": true,
+}
+
+const (
+  alertEnvLabelPrefix      = "ITERATOR_ALERT_LABEL_"
+  alertEnvAnnotationPrefix = "ITERATOR_ALERT_ANNOTATION_"
+)
+
+// ModuleVariable is an input variable declared by a module
+type ModuleVariable struct {
+  Name     string
+  Type     cty.Type
+  Required bool
+}
+
+var variableBlockSchema = &hcl.BodySchema{
+  Blocks: []hcl.BlockHeaderSchema{
+    {Type: "variable", LabelNames: []string{"name"}},
+  },
+}
+
+var variableSchema = &hcl.BodySchema{
+  Attributes: []hcl.AttributeSchema{
+    {Name: "type"},
+    {Name: "default"},
+  },
+}
+
+// ValidateVariables checks the variables of every task against the declarations of its module.
+// Each required input must be set by the task's variables block, by the alert environment,
+// by a variable definitions file of the module or by Iterator's own environment,
+// and the variables block must produce values of the declared types.
+func ValidateVariables(cfg *config.InitConfig) error {
+  var problems []string
+
+  for _, task := range cfg.Tasks {
+    if taskDriver(cfg, task) != "terraform" {
+      log.Debug("Skipping variables validation of task %s, its module is not a Terraform module", task.Name)
+      continue
+    }
+
+    for _, moduleDir := range TaskModules(task) {
+      variables, err := ModuleVariables(moduleDir)
+      if err != nil {
+        log.Warn("Skipping variables validation of task %s: %v", task.Name, err)
+        continue
+      }
+
+      if task.Escalation == nil {
+        for _, problem := range validateTaskVariables(task, moduleDir, variables, task.Variables) {
+          problems = append(problems, fmt.Sprintf("task %s: module %s: %s", task.Name, moduleDir, problem))
+        }
+        continue
+      }
+
+      // Every step of an escalation ladder applies the module with its own inputs
+      for _, step := range task.Escalation.Steps {
+        for _, problem := range validateTaskVariables(task, moduleDir, variables, task.StepVariables(step)) {
+          problems = append(problems, fmt.Sprintf("task %s: module %s: step %s: %s", task.Name, moduleDir, step.Severity, problem))
+        }
+      }
+    }
+  }
+
+  if len(problems) > 0 {
+    return fmt.Errorf("invalid task variables:\n  %s", strings.Join(problems, "\n  "))
+  }
+
+  return nil
+}
+
+// ModuleVariables returns the input variables declared by the Terraform files of a module
+func ModuleVariables(moduleDir string) (map[string]ModuleVariable, error) {
+  entries, err := os.ReadDir(moduleDir)
+  if err != nil {
+    return nil, fmt.Errorf("failed to read module %s: %v", moduleDir, err)
+  }
+
+  parser := hclparse.NewParser()
+  variables := make(map[string]ModuleVariable)
+
+  for _, entry := range entries {
+    if entry.IsDir() {
+      continue
+    }
+
+    path := filepath.Join(moduleDir, entry.Name())
+    var file *hcl.File
+    var diags hcl.Diagnostics
+    switch {
+    case strings.HasSuffix(entry.Name(), ".tf"):
+      file, diags = parser.ParseHCLFile(path)
+    case strings.HasSuffix(entry.Name(), ".tf.json"):
+      file, diags = parser.ParseJSONFile(path)
+    default:
+      continue
+    }
+    if diags.HasErrors() {
+      return nil, fmt.Errorf("failed to parse %s: %s", path, diags)
+    }
+
+    content, _, diags := file.Body.PartialContent(variableBlockSchema)
+    if diags.HasErrors() {
+      return nil, fmt.Errorf("failed to read %s: %s", path, diags)
+    }
+
+    for _, block := range content.Blocks {
+      variable, err := moduleVariable(block)
+      if err != nil {
+        return nil, fmt.Errorf("failed to read %s: %v", path, err)
+      }
+      variables[variable.Name] = variable
+    }
+  }
+
+  return variables, nil
+}
+
+func moduleVariable(block *hcl.Block) (ModuleVariable, error) {
+  variable := ModuleVariable{Name: block.Labels[0], Type: cty.DynamicPseudoType, Required: true}
+
+  content, _, diags := block.Body.PartialContent(variableSchema)
+  if diags.HasErrors() {
+    return variable, fmt.Errorf("variable %s: %s", variable.Name, diags)
+  }
+
+  if attr, ok := content.Attributes["type"]; ok {
+    typ, diags := typeexpr.TypeConstraint(attr.Expr)
+    if diags.HasErrors() {
+      return variable, fmt.Errorf("variable %s: %s", variable.Name, diags)
+    }
+    variable.Type = typ
+  }
+
+  if _, ok := content.Attributes["default"]; ok {
+    variable.Required = false
+  }
+
+  return variable, nil
+}
+
+// validateTaskVariables returns the problems of a task's variables against the module's declarations
+func validateTaskVariables(task *config.Task, moduleDir string, declared map[string]ModuleVariable, variables map[string]string) []string {
+  var problems []string
+  provided := providedVariables(moduleDir)
+
+  // Aggregate and scale runs are for the task as a whole, not for a single alert
+  taskLevel := task.Mode == "aggregate" || task.Condition.TerraformScheduling == "scale"
+
+  vars := map[string]cty.Value{"alert": interpolate.UnknownAlertValue()}
+  if taskLevel {
+    delete(vars, "alert")
+  }
+  if task.ForEach != "" {
+    vars["each"] = interpolate.UnknownEachValue()
+  }
+  ctx := interpolate.EvalContext(nil, vars)
+
+  for _, name := range sortedKeys(variables) {
+    variable, ok := declared[name]
+    if !ok {
+      log.Warn("Task %s sets variable %s which is not declared by module %s", task.Name, name, moduleDir)
+      continue
+    }
+
+    val, err := interpolate.ValueWithContext(variables[name], ctx)
+    if err != nil {
+      problems = append(problems, fmt.Sprintf("variable %s: %v", name, err))
+      continue
+    }
+    _, err = convert.Convert(val, variable.Type)
+    if err != nil {
+      problems = append(problems, fmt.Sprintf("variable %s: %s is not compatible with type %s: %v",
+        name, val.Type().FriendlyName(), typeexpr.TypeString(variable.Type), err))
+    }
+  }
+
+  names := make([]string, 0, len(declared))
+  for name := range declared {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+
+  for _, name := range names {
+    variable := declared[name]
+    if _, ok := variables[name]; ok {
+      continue
+    }
+    if task.Condition.TerraformScheduling == "scale" && name == task.Scale.Variable {
+      if variable.Type != cty.DynamicPseudoType && variable.Type != cty.Number {
+        problems = append(problems, fmt.Sprintf("variable %s of type %s is set to the scale counter, a number", name, typeexpr.TypeString(variable.Type)))
+      }
+      continue
+    }
+    if task.Mode == "aggregate" && name == task.AggregateInput() {
+      continue
+    }
+    if provided[name] {
+      continue
+    }
+    if taskLevel || task.Escalation != nil {
+      // There is no alert environment
+      if variable.Required {
+        problems = append(problems, fmt.Sprintf("required variable %s is not set by the variables block", name))
+      }
+      continue
+    }
+
+    provided, guaranteed := alertEnvProvides(task, name)
+    if !provided {
+      if variable.Required {
+        problems = append(problems, fmt.Sprintf("required variable %s is set neither by the variables block nor by the alert environment", name))
+      }
+      continue
+    }
+
+    if !guaranteed && variable.Required {
+      log.Warn("Task %s relies on variable %s which is only set when alerts carry the matching label or annotation", task.Name, name)
+    }
+    if !variable.Type.IsPrimitiveType() && variable.Type != cty.DynamicPseudoType {
+      problems = append(problems, fmt.Sprintf("variable %s of type %s is set by the alert environment as a string", name, typeexpr.TypeString(variable.Type)))
+    }
+  }
+
+  return problems
+}
+
+// providedVariables returns the input variables Terraform gets a value for without Iterator setting them:
+// those set by the variable definitions files it loads from the module on its own,
+// and those set through TF_VAR_ variables in Iterator's environment, which runs inherit.
+func providedVariables(moduleDir string) map[string]bool {
+  provided := make(map[string]bool)
+
+  for _, env := range os.Environ() {
+    if name := strings.TrimPrefix(env, "TF_VAR_"); name != env {
+      provided[strings.SplitN(name, "=", 2)[0]] = true
+    }
+  }
+
+  entries, err := os.ReadDir(moduleDir)
+  if err != nil {
+    return provided
+  }
+
+  parser := hclparse.NewParser()
+  for _, entry := range entries {
+    name := entry.Name()
+    if entry.IsDir() {
+      continue
+    }
+
+    path := filepath.Join(moduleDir, name)
+    var file *hcl.File
+    var diags hcl.Diagnostics
+    switch {
+    case name == "terraform.tfvars" || strings.HasSuffix(name, ".auto.tfvars"):
+      file, diags = parser.ParseHCLFile(path)
+    case name == "terraform.tfvars.json" || strings.HasSuffix(name, ".auto.tfvars.json"):
+      file, diags = parser.ParseJSONFile(path)
+    default:
+      continue
+    }
+    if diags.HasErrors() {
+      log.Warn("Failed to parse variable definitions file %s: %s", path, diags)
+      continue
+    }
+
+    attrs, diags := file.Body.JustAttributes()
+    if diags.HasErrors() {
+      log.Warn("Failed to read variable definitions file %s: %s", path, diags)
+      continue
+    }
+    for name := range attrs {
+      provided[name] = true
+    }
+  }
+
+  return provided
+}
+
+// alertEnvProvides returns whether a variable is set through the alert environment,
+// and whether every alert matching the task sets it.
+func alertEnvProvides(task *config.Task, name string) (bool, bool) {
+  if alertEnvVariables[name] {
+    return true, true
+  }
+
+  if label := strings.TrimPrefix(name, alertEnvLabelPrefix); label != name {
+    _, matched := task.Condition.Labels[label]
+    return true, matched
+  }
+
+  if strings.HasPrefix(name, alertEnvAnnotationPrefix) {
+    return true, false
+  }
+
+  return false, false
+}
+
+func sortedKeys(m map[string]string) []string {
+  keys := make([]string, 0, len(m))
+  for k := range m {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  return keys
+}
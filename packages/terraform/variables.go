@@ -0,0 +1,56 @@
+package terraform
+
+import (
+  "encoding/json"
+  "fmt"
+  "os"
+  "path/filepath"
+
+  log "github.com/cloudputation/iterator/packages/logger"
+)
+
+// Directory holding the generated variables files, set by InitTerraform
+var varFilesDir string
+
+// VarFilePath returns the path of the variables file of a task for an alert fingerprint.
+// The path is absolute, as Terraform resolves -var-file relative to the module directory.
+func VarFilePath(taskName, fingerprint string) (string, error) {
+  if varFilesDir == "" {
+    return "", fmt.Errorf("variables files are not available before Terraform is initialized")
+  }
+
+  path, err := filepath.Abs(filepath.Join(varFilesDir, pathSafe(taskName), pathSafe(fingerprint)+".tfvars.json"))
+  if err != nil {
+    return "", fmt.Errorf("Failed to resolve variables file path: %v", err)
+  }
+
+  return path, nil
+}
+
+// writeVarFile writes module input variables to a tfvars JSON file
+func writeVarFile(path string, variables map[string]json.RawMessage) error {
+  data, err := json.MarshalIndent(variables, "", "  ")
+  if err != nil {
+    return fmt.Errorf("Failed to encode variables: %v", err)
+  }
+
+  err = os.MkdirAll(filepath.Dir(path), 0755)
+  if err != nil {
+    return fmt.Errorf("Failed to create variables directory: %v", err)
+  }
+
+  err = os.WriteFile(path, data, 0600)
+  if err != nil {
+    return fmt.Errorf("Failed to write variables file %s: %v", path, err)
+  }
+
+  return nil
+}
+
+// removeVarFile deletes a variables file once the resources it was applied with are destroyed
+func removeVarFile(path string) {
+  err := os.Remove(path)
+  if err != nil && !os.IsNotExist(err) {
+    log.Warn("Failed to remove variables file %s: %v", path, err)
+  }
+}
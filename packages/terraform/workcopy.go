@@ -0,0 +1,213 @@
+package terraform
+
+import (
+  "fmt"
+  "io"
+  "io/fs"
+  "os"
+  "path/filepath"
+  "strings"
+
+  log "github.com/cloudputation/iterator/packages/logger"
+)
+
+// Directory holding the working copies of modules, set by InitTerraform
+var workingCopiesDir string
+
+// Directory holding the Terraform data directories of runs with a backend configuration, set by InitTerraform
+var backendDataDir string
+
+// WorkingCopy materializes a copy of a module for a task and alert fingerprint,
+// and returns its directory along with the Terraform data directory it uses.
+// An existing copy is reused, its source files being synced with the module.
+func WorkingCopy(taskName, fingerprint, moduleDir string) (string, string, error) {
+  if workingCopiesDir == "" {
+    return "", "", fmt.Errorf("working copies are not available before Terraform is initialized")
+  }
+
+  copyDir := filepath.Join(workingCopiesDir, pathSafe(taskName), pathSafe(fingerprint))
+  err := pruneCopy(moduleDir, copyDir)
+  if err == nil {
+    err = copyModule(moduleDir, copyDir)
+  }
+  if err != nil {
+    return "", "", fmt.Errorf("Failed to create working copy of module %s: %v", moduleDir, err)
+  }
+
+  return copyDir, filepath.Join(copyDir, ".terraform"), nil
+}
+
+// RemoveWorkingCopy deletes a working copy created by WorkingCopy
+func RemoveWorkingCopy(copyDir string) error {
+  return removeRunDir(workingCopiesDir, copyDir, "working copy")
+}
+
+// IsolateBackend gives a run with a backend configuration a Terraform data directory of its own,
+// so that runs sharing a module directory don't re-initialize each other's backend between init and apply.
+// Runs in a working copy already have their own data directory.
+func (o *Options) IsolateBackend(taskName, runID string) error {
+  if len(o.BackendConfig) == 0 || o.DataDir != "" {
+    return nil
+  }
+  if backendDataDir == "" {
+    return fmt.Errorf("backend data directories are not available before Terraform is initialized")
+  }
+
+  dataDir, err := filepath.Abs(filepath.Join(backendDataDir, pathSafe(taskName), pathSafe(runID)))
+  if err != nil {
+    return fmt.Errorf("Failed to resolve backend data directory: %v", err)
+  }
+  o.DataDir = dataDir
+
+  return nil
+}
+
+// DiscardRun deletes the files of a run whose record is dropped without its resources being destroyed,
+// or whose resources were handed over to another run: its variables file, and its working copy or backend data directory.
+func DiscardRun(moduleDir string, opts Options) {
+  if opts.VarFile != "" {
+    removeVarFile(opts.VarFile)
+  }
+
+  err := removeRunDirs(moduleDir, opts)
+  if err != nil {
+    log.Warn("Failed to remove the files of the run of module %s: %v", moduleDir, err)
+  }
+}
+
+// removeRunDirs deletes the working copy or the backend data directory a run used
+func removeRunDirs(moduleDir string, opts Options) error {
+  if opts.DataDir == "" {
+    return nil
+  }
+  if isUnder(backendDataDir, opts.DataDir) {
+    return removeRunDir(backendDataDir, opts.DataDir, "backend data directory")
+  }
+  return RemoveWorkingCopy(moduleDir)
+}
+
+// removeRunDir deletes a directory Iterator created for a run under root
+func removeRunDir(root, dir, kind string) error {
+  if !isUnder(root, dir) {
+    return fmt.Errorf("refusing to remove %s which is not a %s", dir, kind)
+  }
+
+  err := os.RemoveAll(dir)
+  if err != nil {
+    return fmt.Errorf("Failed to remove %s %s: %v", kind, dir, err)
+  }
+  log.Info("Removed %s: %s", kind, dir)
+
+  return nil
+}
+
+// isUnder returns true if dir is a directory below root
+func isUnder(root, dir string) bool {
+  if root == "" {
+    return false
+  }
+  rel, err := filepath.Rel(root, dir)
+  return err == nil && !strings.HasPrefix(rel, "..") && rel != "."
+}
+
+// copyModule copies the source files of a module, leaving out Terraform's own working files
+func copyModule(src, dst string) error {
+  return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+    if err != nil {
+      return err
+    }
+
+    rel, err := filepath.Rel(src, path)
+    if err != nil {
+      return err
+    }
+    target := filepath.Join(dst, rel)
+
+    if d.IsDir() {
+      if path != src && hashExcludedDirs[d.Name()] {
+        return filepath.SkipDir
+      }
+      return os.MkdirAll(target, 0755)
+    }
+    if hashExcludedFiles[d.Name()] || strings.HasSuffix(d.Name(), ".tfstate") {
+      return nil
+    }
+
+    info, err := os.Stat(path)
+    if err != nil || !info.Mode().IsRegular() {
+      return nil
+    }
+
+    return copyFile(path, target, info.Mode().Perm())
+  })
+}
+
+// pruneCopy removes the source files of a working copy that no longer exist in the module,
+// so that a file removed from the module stops being part of the copy.
+func pruneCopy(src, dst string) error {
+  if _, err := os.Stat(dst); os.IsNotExist(err) {
+    return nil
+  }
+
+  return filepath.WalkDir(dst, func(path string, d fs.DirEntry, err error) error {
+    if err != nil {
+      return err
+    }
+    if path == dst {
+      return nil
+    }
+    if d.IsDir() && hashExcludedDirs[d.Name()] {
+      return filepath.SkipDir
+    }
+    if !d.IsDir() && (hashExcludedFiles[d.Name()] || strings.HasSuffix(d.Name(), ".tfstate")) {
+      return nil
+    }
+
+    rel, err := filepath.Rel(dst, path)
+    if err != nil {
+      return err
+    }
+    if _, err := os.Stat(filepath.Join(src, rel)); !os.IsNotExist(err) {
+      return nil
+    }
+
+    log.Debug("Removing %s from working copy %s, it was removed from module %s", rel, dst, src)
+    if d.IsDir() {
+      err = os.RemoveAll(path)
+      if err != nil {
+        return err
+      }
+      return filepath.SkipDir
+    }
+    return os.Remove(path)
+  })
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+  in, err := os.Open(src)
+  if err != nil {
+    return err
+  }
+  defer in.Close()
+
+  out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+  if err != nil {
+    return err
+  }
+
+  _, err = io.Copy(out, in)
+  if closeErr := out.Close(); err == nil {
+    err = closeErr
+  }
+
+  return err
+}
+
+// pathSafe turns a name into a single path element
+func pathSafe(name string) string {
+  name = strings.ReplaceAll(name, string(filepath.Separator), "_")
+  if name == "" || name == "." || name == ".." {
+    return "_"
+  }
+  return name
+}